@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"time"
 )
 
 // Message is a reddit post or comment downloaded by bdfr.
@@ -19,6 +20,17 @@ func (m Message) GetString(key string) string {
 	return st.(string)
 }
 
+// GetTime retrieves message's value with the given key and interprets it as a
+// unix timestamp in seconds (e.g., "created_utc"). It returns the zero time if
+// the message does not contain the given key or the value is not a number.
+func (m Message) GetTime(key string) time.Time {
+	f, ok := m[key].(float64)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(int64(f), 0).UTC()
+}
+
 // SetString assigns the specified key-value pair to a message.
 func (m Message) SetString(key string, val string) {
 	m[key] = val
@@ -58,8 +70,13 @@ func ReadMessage(filename string) (Message, error) {
 		return nil, err
 	}
 
+	return ParseMessage(b)
+}
+
+// ParseMessage unmarshals a bdfr message from its json encoding.
+func ParseMessage(b []byte) (Message, error) {
 	m := Message{}
-	err = json.Unmarshal(b, &m)
+	err := json.Unmarshal(b, &m)
 	if err != nil {
 		return nil, err
 	}
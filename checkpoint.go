@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/ccollins476ad/bdfrscrape/download"
+	"github.com/ccollins476ad/bdfrscrape/fileutil"
+	log "github.com/sirupsen/logrus"
+)
+
+// Checkpoint records the posts that an interrupted run finished, so that the
+// next run can skip them. Its methods are safe for concurrent use.
+type Checkpoint struct {
+	Source string   `json:"source"` // Source directory of the interrupted run.
+	Done   []string `json:"done"`   // Post filenames, relative to the source directory.
+
+	done map[string]struct{}
+	mtx  sync.Mutex
+}
+
+// CheckpointPath returns the path of the checkpoint file inside the given
+// destination directory.
+func CheckpointPath(destDir string) string {
+	return filepath.Join(destDir, download.StateDirName, "checkpoint.json")
+}
+
+func NewCheckpoint(source string) *Checkpoint {
+	return &Checkpoint{
+		Source: source,
+		done:   map[string]struct{}{},
+	}
+}
+
+// LoadCheckpoint reads a checkpoint from disk. It returns an empty checkpoint
+// if the file does not exist or if it was written by a run with a different
+// source directory.
+func LoadCheckpoint(path string, source string) (*Checkpoint, error) {
+	c := NewCheckpoint(source)
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return c, nil
+		}
+		return nil, err
+	}
+
+	var prev Checkpoint
+	err = json.Unmarshal(b, &prev)
+	if err != nil {
+		return nil, err
+	}
+
+	if prev.Source != source {
+		log.Infof("ignoring checkpoint from a different source: have=%s want=%s", prev.Source, source)
+		return c, nil
+	}
+
+	for _, filename := range prev.Done {
+		c.done[filename] = struct{}{}
+	}
+	log.Infof("resuming from checkpoint: done=%d", len(c.done))
+
+	return c, nil
+}
+
+// Has returns true if the given post was finished by an earlier run.
+func (c *Checkpoint) Has(filename string) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	_, ok := c.done[filename]
+	return ok
+}
+
+// Add marks the given post as finished.
+func (c *Checkpoint) Add(filename string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.done[filename] = struct{}{}
+}
+
+// Save writes the checkpoint to disk.
+func (c *Checkpoint) Save(path string) error {
+	c.mtx.Lock()
+	c.Done = make([]string, 0, len(c.done))
+	for filename := range c.done {
+		c.Done = append(c.Done, filename)
+	}
+	sort.Strings(c.Done)
+	b, err := json.MarshalIndent(c, "", "  ")
+	c.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	return fileutil.WriteFileAtomic(path, b, 0644)
+}
+
+// RemoveCheckpoint deletes the checkpoint file, if any. A run that finishes
+// every post calls it so that the next run starts from scratch.
+func RemoveCheckpoint(path string) error {
+	err := os.Remove(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// command is a bdfrscrape subcommand.
+type command struct {
+	Name     string                                // Name given on the command line.
+	Synopsis string                                // Arguments, e.g., "[option]... <dest_dir>".
+	Desc     string                                // One-line description.
+	Notes    string                                // Help text printed after the options, if any.
+	Run      func(cmd *command, args []string) int // Runs the command and returns the exit status.
+}
+
+// errUsage indicates a command line error that has already been reported.
+var errUsage = errors.New("usage error")
+
+// commands returns every subcommand, in the order that help lists them. The
+// first is the default: it runs if the first argument doesn't name a command.
+func commands() []*command {
+	return []*command{
+		{
+			Name:     "scrape",
+			Synopsis: "[option]... <source> <dest_dir>",
+			Desc:     "Scrapes media links from a bdfr archive.",
+			Notes:    "Exit status is 3 if any post failed or the run stopped early, 4 if only links failed, 130 if interrupted.",
+			Run:      runScrape,
+		},
+		{
+			Name:     "report",
+			Synopsis: "[option]... <dest_dir>",
+			Desc:     "Summarizes the last scrape of a destination directory.",
+			Run:      runReport,
+		},
+		{
+			Name:     "verify",
+			Synopsis: "[option]... <dest_dir>",
+			Desc:     "Checks a destination directory for broken links, damaged files and unreferenced media.",
+			Notes:    "Exit status is 4 if any problem was found.",
+			Run:      runVerify,
+		},
+		{
+			Name:     "gc",
+			Synopsis: "[option]... <dest_dir>",
+			Desc:     "Lists, and optionally removes, media files that no processed post links to.",
+			Run:      runGC,
+		},
+		{
+			Name:     "config",
+			Synopsis: "dump [option]...",
+			Desc:     "Prints the effective scrape configuration that the given options produce.",
+			Run:      runConfig,
+		},
+		{
+			Name:     "serve",
+			Synopsis: "[option]... <dest_dir>",
+			Desc:     "Serves a destination directory over http for browsing.",
+			Run:      runServe,
+		},
+	}
+}
+
+// findCommand returns the command with the given name, or nil if there is
+// none.
+func findCommand(name string) *command {
+	for _, cmd := range commands() {
+		if cmd.Name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func progName() string {
+	return filepath.Base(os.Args[0])
+}
+
+// usage prints the top-level help text.
+func usage() {
+	w := os.Stderr
+	fmt.Fprintf(w, "Usage: %s <command> [argument]...\n", progName())
+	fmt.Fprintf(w, "       %s [option]... <source> <dest_dir>  (same as scrape)\n", progName())
+	fmt.Fprintf(w, "Commands:\n")
+	for _, cmd := range commands() {
+		fmt.Fprintf(w, "  %-8s %s\n", cmd.Name, cmd.Desc)
+	}
+	fmt.Fprintf(w, "Run '%s <command> -h' for a command's options.\n", progName())
+}
+
+// flagSet returns a new flag set for the command, whose usage message
+// describes the command.
+func (cmd *command) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.Name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s %s\n", progName(), cmd.Name, cmd.Synopsis)
+		fmt.Fprintf(fs.Output(), "%s\n", cmd.Desc)
+		fs.PrintDefaults()
+		if cmd.Notes != "" {
+			fmt.Fprintf(fs.Output(), "%s\n", cmd.Notes)
+		}
+	}
+	return fs
+}
+
+// parseFlags parses the given command line arguments with fs and returns the
+// positional arguments. The required parameter names the positional
+// arguments that must be present.
+func parseFlags(fs *flag.FlagSet, args []string, required ...string) ([]string, error) {
+	err := fs.Parse(args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, err
+		}
+		// The flag package has already reported the error.
+		return nil, errUsage
+	}
+
+	if fs.NArg() < len(required) {
+		return nil, fmt.Errorf("missing required argument: %s", required[fs.NArg()])
+	}
+
+	return fs.Args(), nil
+}
+
+// usageError reports a command line error and returns the exit status for
+// it.
+func usageError(fs *flag.FlagSet, err error) int {
+	switch {
+	case errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.Is(err, errUsage):
+		return 1
+	default:
+		printFatalError(err)
+		fs.Usage()
+		return 1
+	}
+}
@@ -0,0 +1,32 @@
+package download
+
+import (
+	"encoding/json"
+)
+
+// Attribution credits the author of a media file and states its license.
+// bdfrscrape saves it in a sidecar file next to the media file it describes.
+type Attribution struct {
+	Source     string `json:"source"`                // Page that published the media.
+	Title      string `json:"title,omitempty"`       // Title of the work.
+	Author     string `json:"author,omitempty"`      // Name of the author.
+	AuthorURL  string `json:"author_url,omitempty"`  // Author's profile page.
+	License    string `json:"license,omitempty"`     // Short license name (e.g., "CC BY-SA 4.0").
+	LicenseURL string `json:"license_url,omitempty"` // Full text of the license.
+	Credit     string `json:"credit,omitempty"`      // Credit line requested by the source.
+}
+
+// SidecarFilename returns the name of the attribution sidecar that belongs to
+// the given media file.
+func SidecarFilename(filename string) string {
+	return filename + ".attribution.json"
+}
+
+// SaveAttribution writes an attribution sidecar next to the given media file.
+func (s *Store) SaveAttribution(filename string, a *Attribution) error {
+	b, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s.SaveFile(SidecarFilename(filename), b)
+}
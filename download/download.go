@@ -2,20 +2,114 @@ package download
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"regexp"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// ErrNotMedia indicates that a url expected to hold media returned an html
+// page instead (e.g., a video player or a login form).
+var ErrNotMedia = errors.New("response is an html page, not media")
+
+// ErrRemoved indicates that a host answered a request for media with the
+// placeholder it shows for removed media (e.g., imgur's removed.png) rather
+// than with an error status.
+var ErrRemoved = errors.New("media removed")
+
+// removedPlaceholders match the urls that hosts redirect requests for removed
+// media to. The placeholders come with 200 OK, so only the final url of the
+// request tells them apart from the media.
+var removedPlaceholders = []*regexp.Regexp{
+	regexp.MustCompile(`^https?://(i\.)?imgur\.com/removed\.png$`),
+	regexp.MustCompile(`^https?://s\.yimg\.com/.*/photo_unavailable(_[a-z])?\.(gif|png)$`),
+}
+
+// StatusError indicates that an http request received a non-2xx response.
+type StatusError struct {
+	Code   int    // Http status code (e.g., 404).
+	Status string // Http status text (e.g., "404 Not Found").
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("error status: %s", e.Status)
+}
+
+// IsPermanent returns true if err indicates that the requested resource is
+// gone for good (e.g., 404 Not Found, or a redirect to a host's placeholder
+// for removed media), such that retrying would not help.
+func IsPermanent(err error) bool {
+	if errors.Is(err, ErrRemoved) {
+		return true
+	}
+
+	var se *StatusError
+	if !errors.As(err, &se) {
+		return false
+	}
+
+	switch se.Code {
+	case http.StatusNotFound, http.StatusGone, http.StatusUnavailableForLegalReasons:
+		return true
+	default:
+		return false
+	}
+}
+
 // GetBody performs an http GET with url=u using the suppplied client and
 // header.
 func GetBody(ctx context.Context, hc *http.Client, u string, header http.Header) (io.ReadCloser, error) {
+	rsp, err := GetResponse(ctx, hc, u, header)
+	if err != nil {
+		return nil, err
+	}
+
+	return rsp.Body, nil
+}
+
+// GetResponse is like GetBody, but it returns the full http response so that
+// the caller can inspect its header. The caller must close the response body.
+func GetResponse(ctx context.Context, hc *http.Client, u string, header http.Header) (*http.Response, error) {
 	log.Debugf("get: %s", u)
 
-	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	return do(ctx, hc, "GET", u, header)
+}
+
+// Head performs an http HEAD with url=u using the supplied client and header.
+// The returned response has no body to close.
+func Head(ctx context.Context, hc *http.Client, u string, header http.Header) (*http.Response, error) {
+	log.Debugf("head: %s", u)
+
+	rsp, err := do(ctx, hc, "HEAD", u, header)
+	if err != nil {
+		return nil, err
+	}
+	rsp.Body.Close()
+
+	return rsp, nil
+}
+
+// isRemovedPlaceholder returns true if url=u is one that hosts redirect
+// requests for removed media to.
+func isRemovedPlaceholder(u string) bool {
+	for _, re := range removedPlaceholders {
+		if re.MatchString(u) {
+			return true
+		}
+	}
+	return false
+}
+
+// do sends an http request and returns the response. It returns an error if
+// the response has a non-2xx status, or if the request was redirected to a
+// placeholder for removed media.
+func do(ctx context.Context, hc *http.Client, method string, u string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -31,14 +125,29 @@ func GetBody(ctx context.Context, hc *http.Client, u string, header http.Header)
 	}
 
 	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
-		return nil, fmt.Errorf("error status: %s", rsp.Status)
+		rsp.Body.Close()
+		return nil, &StatusError{
+			Code:   rsp.StatusCode,
+			Status: rsp.Status,
+		}
 	}
 
-	return rsp.Body, nil
+	if final := rsp.Request.URL.String(); final != u && isRemovedPlaceholder(final) {
+		rsp.Body.Close()
+		return nil, fmt.Errorf("%w: url=%s placeholder=%s", ErrRemoved, u, final)
+	}
+
+	return rsp, nil
 }
 
 // Get calls GetBody(), then reads the full response and returns the result.
 func Get(ctx context.Context, hc *http.Client, u string, header http.Header) ([]byte, error) {
+	return GetLimited(ctx, hc, u, header, 0)
+}
+
+// GetLimited is like Get, but it fails if the response body is larger than
+// limit bytes. A limit of 0 means no limit.
+func GetLimited(ctx context.Context, hc *http.Client, u string, header http.Header, limit int64) ([]byte, error) {
 	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
@@ -48,5 +157,49 @@ func Get(ctx context.Context, hc *http.Client, u string, header http.Header) ([]
 	}
 	defer body.Close()
 
-	return io.ReadAll(NewContextReader(ctx, body))
+	return readLimited(ctx, body, limit)
+}
+
+// GetMedia is like GetLimited, but it fails with ErrNotMedia if the response
+// is an html page.
+func GetMedia(ctx context.Context, hc *http.Client, u string, header http.Header, limit int64) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	rsp, err := GetResponse(ctx, hc, u, header)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	if IsHTML(rsp.Header) {
+		return nil, ErrNotMedia
+	}
+
+	return readLimited(ctx, rsp.Body, limit)
+}
+
+// IsHTML returns true if the given response header declares an html body.
+func IsHTML(header http.Header) bool {
+	mt, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mt == "text/html" || mt == "application/xhtml+xml"
+}
+
+// readLimited reads body in full. It fails if the body is larger than limit
+// bytes. A limit of 0 means no limit.
+func readLimited(ctx context.Context, body io.Reader, limit int64) ([]byte, error) {
+	var r io.Reader = NewContextReader(ctx, body)
+	if limit > 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && int64(len(b)) > limit {
+		return nil, fmt.Errorf("response body exceeds size limit: limit=%d", limit)
+	}
+
+	return b, nil
 }
@@ -0,0 +1,100 @@
+package download
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+// newStandIn returns a server that stands in for a media host. It serves
+// media at /ok, fails with the status in the path at /status/<code>, and
+// redirects /gone to a removed-media placeholder.
+func newStandIn(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	})
+	mux.HandleFunc("/status/404", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	})
+	mux.HandleFunc("/status/410", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusGone)
+	})
+	mux.HandleFunc("/status/503", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	})
+	mux.HandleFunc("/gone", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/removed.png", http.StatusFound)
+	})
+	mux.HandleFunc("/removed.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("placeholder"))
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	// Treat the server's placeholder like imgur's.
+	saved := removedPlaceholders
+	removedPlaceholders = append([]*regexp.Regexp{
+		regexp.MustCompile("^" + regexp.QuoteMeta(srv.URL) + `/removed\.png$`),
+	}, saved...)
+	t.Cleanup(func() {
+		removedPlaceholders = saved
+	})
+
+	return srv
+}
+
+func TestIsPermanent(t *testing.T) {
+	srv := newStandIn(t)
+
+	tests := []struct {
+		path      string
+		wantErr   bool
+		permanent bool
+	}{
+		{path: "/ok"},
+		{path: "/status/404", wantErr: true, permanent: true},
+		{path: "/status/410", wantErr: true, permanent: true},
+		{path: "/status/503", wantErr: true},
+		{path: "/gone", wantErr: true, permanent: true},
+		{path: "/removed.png"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			_, err := Get(context.Background(), srv.Client(), srv.URL+tt.path, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err=%v, want error=%v", err, tt.wantErr)
+			}
+			if got := IsPermanent(err); got != tt.permanent {
+				t.Errorf("IsPermanent(%v)=%v, want %v", err, got, tt.permanent)
+			}
+		})
+	}
+}
+
+func TestIsRemovedPlaceholder(t *testing.T) {
+	tests := []struct {
+		u    string
+		want bool
+	}{
+		{u: "https://i.imgur.com/removed.png", want: true},
+		{u: "https://imgur.com/removed.png", want: true},
+		{u: "https://s.yimg.com/pw/images/en-us/photo_unavailable.png", want: true},
+		{u: "https://s.yimg.com/pw/images/en-us/photo_unavailable_l.gif", want: true},
+		{u: "https://i.imgur.com/removed.png.jpg"},
+		{u: "https://i.imgur.com/abcdefg.png"},
+		{u: "https://example.com/removed.png"},
+	}
+
+	for _, tt := range tests {
+		if got := isRemovedPlaceholder(tt.u); got != tt.want {
+			t.Errorf("isRemovedPlaceholder(%q)=%v, want %v", tt.u, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package download
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ccollins476ad/bdfrscrape/fileutil"
+)
+
+// StateDirName is the name of the directory, inside the destination
+// directory, where bdfrscrape keeps its own bookkeeping files.
+const StateDirName = ".bdfrscrape"
+
+// ManifestEntry describes a file that bdfrscrape saved to the destination
+// directory.
+type ManifestEntry struct {
+	URL          string       `json:"url,omitempty"`           // Url that the file was saved from.
+	Aliases      []string     `json:"aliases,omitempty"`       // Other links that resolved to the file (e.g., before a downloader normalized them).
+	Size         int64        `json:"size"`                    // Size of the file, in bytes.
+	SHA256       string       `json:"sha256"`                  // Hex-encoded hash of the file contents.
+	Saved        time.Time    `json:"saved"`                   // Time the file was written.
+	OriginalName string       `json:"original_name,omitempty"` // Name the uploader gave the file, if known.
+	Archive      *ArchiveInfo `json:"archive,omitempty"`       // Non-nil if recovered from a web archive.
+}
+
+// ArchiveInfo records the web archive capture that a file was recovered from.
+type ArchiveInfo struct {
+	Service     string `json:"service"`      // Name of the archive (e.g., "wayback").
+	SnapshotURL string `json:"snapshot_url"` // Url of the capture that was saved.
+	Timestamp   string `json:"timestamp"`    // Capture time, in the archive's format.
+}
+
+// PostEntry describes a source post as it was when bdfrscrape last processed
+// it.
+type PostEntry struct {
+	Size     int64     `json:"size"`     // Size of the source file, in bytes.
+	ModTime  time.Time `json:"mod_time"` // Modification time of the source file.
+	SHA256   string    `json:"sha256"`   // Hex-encoded hash of the source file contents.
+	Resolved bool      `json:"resolved"` // True if none of the post's links failed or still need downloading.
+
+	// Prefix of the local media links in the processed post. Nil if unknown
+	// (i.e., processed by an older version).
+	LinkPrefix *string `json:"link_prefix,omitempty"`
+
+	// How the processed post keeps the original urls of rewritten links (see
+	// the keep-original option). Nil if unknown.
+	KeepOriginal *string `json:"keep_original,omitempty"`
+}
+
+// Manifest records every file that bdfrscrape has saved to a destination
+// directory, and the source posts it has processed. It is safe for concurrent
+// use.
+type Manifest struct {
+	mtx   sync.Mutex
+	Files map[string]*ManifestEntry `json:"files"`           // Keyed by filename, relative to the destination directory.
+	Posts map[string]*PostEntry     `json:"posts,omitempty"` // Keyed by filename, relative to the source directory.
+	urls  map[string]string         // Url (and alias) -> filename index of Files.
+}
+
+// ManifestPath returns the path of the manifest belonging to the given
+// destination directory.
+func ManifestPath(destDir string) string {
+	return filepath.Join(destDir, StateDirName, "manifest.json")
+}
+
+func NewManifest() *Manifest {
+	return &Manifest{
+		Files: map[string]*ManifestEntry{},
+		Posts: map[string]*PostEntry{},
+		urls:  map[string]string{},
+	}
+}
+
+// LoadManifest reads a manifest from disk. It returns an empty manifest if the
+// file does not exist.
+func LoadManifest(path string) (*Manifest, error) {
+	m := NewManifest()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return m, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, m)
+	if err != nil {
+		return nil, err
+	}
+	if m.Files == nil {
+		m.Files = map[string]*ManifestEntry{}
+	}
+	if m.Posts == nil {
+		m.Posts = map[string]*PostEntry{}
+	}
+	for filename, e := range m.Files {
+		for _, alias := range e.Aliases {
+			m.urls[alias] = filename
+		}
+		if e.URL != "" {
+			m.urls[e.URL] = filename
+		}
+	}
+
+	return m, nil
+}
+
+// Save writes the manifest to disk.
+func (m *Manifest) Save(path string) error {
+	m.mtx.Lock()
+	b, err := json.MarshalIndent(m, "", "  ")
+	m.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	return fileutil.WriteFileAtomic(path, b, 0644)
+}
+
+// Lookup returns a copy of the entry for the given filename.
+func (m *Manifest) Lookup(filename string) (ManifestEntry, bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	e := m.Files[filename]
+	if e == nil {
+		return ManifestEntry{}, false
+	}
+	return *e, true
+}
+
+// FilenameForURL returns the name of the file that was saved from the given
+// url, or that the url is an alias of.
+func (m *Manifest) FilenameForURL(u string) (string, bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	filename, ok := m.urls[u]
+	return filename, ok
+}
+
+// Update applies fn to the entry for the given filename, creating the entry if
+// it does not exist.
+func (m *Manifest) Update(filename string, fn func(e *ManifestEntry)) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	e := m.Files[filename]
+	if e == nil {
+		e = &ManifestEntry{}
+		m.Files[filename] = e
+	}
+	fn(e)
+
+	if e.URL != "" {
+		m.urls[e.URL] = filename
+	}
+}
+
+// Remove deletes the entry for the given filename, if any.
+func (m *Manifest) Remove(filename string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	e := m.Files[filename]
+	if e == nil {
+		return
+	}
+	if e.URL != "" && m.urls[e.URL] == filename {
+		delete(m.urls, e.URL)
+	}
+	for _, alias := range e.Aliases {
+		if m.urls[alias] == filename {
+			delete(m.urls, alias)
+		}
+	}
+	delete(m.Files, filename)
+}
+
+// AddAlias records that the given link resolved to the given file, so that
+// FilenameForURL finds the file by the link too. It does nothing if the
+// manifest has no entry for the file.
+func (m *Manifest) AddAlias(filename string, link string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	e := m.Files[filename]
+	if e == nil || e.URL == link || m.urls[link] == filename {
+		return
+	}
+
+	e.Aliases = append(e.Aliases, link)
+	m.urls[link] = filename
+}
+
+// LookupPost returns a copy of the entry for the given source post.
+func (m *Manifest) LookupPost(filename string) (PostEntry, bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	e := m.Posts[filename]
+	if e == nil {
+		return PostEntry{}, false
+	}
+	return *e, true
+}
+
+// UpdatePost replaces the entry for the given source post.
+func (m *Manifest) UpdatePost(filename string, e PostEntry) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.Posts[filename] = &e
+}
+
+// recordSave updates the entry for a file that was just written. The sum
+// parameter is the SHA-256 hash of the file's contents.
+func (m *Manifest) recordSave(filename string, u string, size int64, sum []byte) {
+	m.Update(filename, func(e *ManifestEntry) {
+		if u != "" {
+			e.URL = u
+		}
+		e.Size = size
+		e.SHA256 = hex.EncodeToString(sum)
+		e.Saved = time.Now().UTC()
+	})
+}
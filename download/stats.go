@@ -0,0 +1,35 @@
+package download
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Stats accumulates the number of bytes that downloads performed with a
+// particular context have fetched. It is safe for concurrent use.
+type Stats struct {
+	bytes atomic.Int64
+}
+
+type statsKey struct{}
+
+// WithStats returns a copy of ctx that counts the bytes fetched with it in the
+// returned Stats.
+func WithStats(ctx context.Context) (context.Context, *Stats) {
+	st := &Stats{}
+	return context.WithValue(ctx, statsKey{}, st), st
+}
+
+// CountBytes adds n to the byte count of the Stats attached to ctx, if any.
+// Readers created with NewContextReader count their bytes automatically.
+func CountBytes(ctx context.Context, n int64) {
+	st, _ := ctx.Value(statsKey{}).(*Stats)
+	if st != nil {
+		st.bytes.Add(n)
+	}
+}
+
+// Bytes returns the number of bytes fetched so far.
+func (st *Stats) Bytes() int64 {
+	return st.bytes.Load()
+}
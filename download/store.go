@@ -2,10 +2,13 @@ package download
 
 import (
 	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"sync"
 
 	"github.com/ccollins476ad/bdfrscrape/fileutil"
@@ -20,9 +23,11 @@ type Store struct {
 	destDir string // constant
 
 	hc *http.Client
+	m  *Manifest
 
-	seenMtx sync.Mutex          // Protects the "seen" field.
+	seenMtx sync.Mutex          // Protects the "seen" and "urls" fields.
 	seen    map[string]struct{} // Media URLs we have already seen.
+	urls    map[string]string   // Filename -> url, for urls evaluated this run.
 }
 
 // Desc decribes a media file.
@@ -31,18 +36,42 @@ type Desc struct {
 	IsLocal  bool   // True if file already downloaded
 }
 
-func NewStore(destDir string) *Store {
+// NewStore returns a store that saves media to destDir, records it in m, and
+// fetches it with hc.
+func NewStore(destDir string, m *Manifest, hc *http.Client) *Store {
 	return &Store{
 		destDir: destDir,
-		hc:      &http.Client{},
+		hc:      hc,
+		m:       m,
 		seen:    map[string]struct{}{},
+		urls:    map[string]string{},
 	}
 }
 
+// localFilename returns the name of the file previously saved from url=u, if
+// the manifest records one and it is still on disk.
+func (s *Store) localFilename(u string) (string, bool) {
+	filename, ok := s.m.FilenameForURL(u)
+	if !ok || !fileutil.FileExists(s.destDir+"/"+filename) {
+		return "", false
+	}
+	return filename, true
+}
+
 // EvaluateURL returns a descriptor for the media file that the given url
 // points to. It does not download anything. The `IsLocal` field in the
-// descriptor is true if the file has already been downloaded.
+// descriptor is true if the file has already been downloaded, either under
+// the name derived from the url or under the name the manifest records for
+// it.
 func (s *Store) EvaluateURL(u string) (*Desc, error) {
+	if filename, ok := s.localFilename(u); ok {
+		log.Debugf("skipping %s: manifest lists file: %s", u, filename)
+		return &Desc{
+			Filename: filename,
+			IsLocal:  true,
+		}, nil
+	}
+
 	filename, err := URLToFilename(u)
 	if err != nil {
 		log.WithError(err).Errorf("failed to convert url to filename: url=%s", u)
@@ -58,7 +87,7 @@ func (s *Store) EvaluateURL(u string) (*Desc, error) {
 		}, nil
 	}
 
-	already := s.see(u)
+	already := s.see(u, filename)
 	if already {
 		return nil, AlreadyAttempted
 	}
@@ -69,10 +98,91 @@ func (s *Store) EvaluateURL(u string) (*Desc, error) {
 	}, nil
 }
 
+// Lookup returns the local filename of the given media url if the file has
+// already been downloaded. Unlike EvaluateURL, it does not mark the url as
+// seen.
+func (s *Store) Lookup(u string) (string, bool) {
+	if filename, ok := s.localFilename(u); ok {
+		return filename, true
+	}
+
+	filename, err := URLToFilename(u)
+	if err != nil {
+		return "", false
+	}
+
+	if !fileutil.FileExists(s.destDir + "/" + filename) {
+		return "", false
+	}
+
+	return filename, true
+}
+
+// SaveFile writes a file to the destination directory and records it in the
+// manifest. If the file's name was derived from a url evaluated by this
+// store, the manifest entry credits that url.
 func (s *Store) SaveFile(relPath string, b []byte) error {
 	destPath := s.destDir + "/" + relPath
 	log.Infof("downloading %s", destPath)
-	return os.WriteFile(destPath, b, 0644)
+
+	err := fileutil.WriteFileAtomic(destPath, b, 0644)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(b)
+	s.m.recordSave(relPath, s.urlFor(relPath), int64(len(b)), sum[:])
+
+	return nil
+}
+
+// ImportFile moves a file that was written outside the store (e.g., by an
+// external program) into the destination directory and records it in the
+// manifest. The srcPath file must be on the same filesystem as the
+// destination directory; TempDir returns a suitable location.
+func (s *Store) ImportFile(relPath string, srcPath string) error {
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	destPath := s.destDir + "/" + relPath
+	log.Infof("importing %s --> %s", srcPath, destPath)
+
+	err = os.Rename(srcPath, destPath)
+	if err != nil {
+		return err
+	}
+
+	s.m.recordSave(relPath, s.urlFor(relPath), size, h.Sum(nil))
+
+	return nil
+}
+
+// TempDir creates a new, empty scratch directory on the same filesystem as
+// the destination directory. The caller is responsible for removing it.
+func (s *Store) TempDir() (string, error) {
+	parent := filepath.Join(s.destDir, StateDirName, "tmp")
+	err := os.MkdirAll(parent, 0755)
+	if err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(parent, "")
+}
+
+// urlFor returns the url that the given filename was derived from this run,
+// or "" if it is unknown.
+func (s *Store) urlFor(relPath string) string {
+	s.seenMtx.Lock()
+	defer s.seenMtx.Unlock()
+
+	return s.urls[relPath]
 }
 
 // DownloadAs ensures the given media file has been downloaded. It downloads
@@ -82,6 +192,14 @@ func (s *Store) SaveFile(relPath string, b []byte) error {
 // local path of the media file, relative to the configured destination
 // directory.
 func (s *Store) DownloadAs(ctx context.Context, u string, header http.Header, filename string) (string, error) {
+	return s.DownloadLimited(ctx, u, header, filename, 0)
+}
+
+// DownloadLimited is like DownloadAs, but it fails without saving anything if
+// the media file is larger than limit bytes. A limit of 0 means no limit.
+// Like every Download method, it fails with ErrNotMedia if the url returns an
+// html page.
+func (s *Store) DownloadLimited(ctx context.Context, u string, header http.Header, filename string, limit int64) (string, error) {
 	desc, err := s.EvaluateURL(u)
 	if err != nil {
 		return "", err
@@ -92,7 +210,7 @@ func (s *Store) DownloadAs(ctx context.Context, u string, header http.Header, fi
 		return desc.Filename, nil
 	}
 
-	b, err := Get(ctx, s.hc, u, header)
+	b, err := GetMedia(ctx, s.hc, u, header, limit)
 	if err != nil {
 		return "", err
 	}
@@ -121,10 +239,15 @@ func (s *Store) HTTPClient() *http.Client {
 	return s.hc
 }
 
+// Manifest returns the manifest that records the store's saved files.
+func (s *Store) Manifest() *Manifest {
+	return s.m
+}
+
 // see returns true if the media save has already attempted to download the
-// specified media url. Otherwise, it marks the url as "seen" and returns
-// false.
-func (s *Store) see(u string) bool {
+// specified media url. Otherwise, it marks the url as "seen", remembers that
+// the url maps to the given filename, and returns false.
+func (s *Store) see(u string, filename string) bool {
 	s.seenMtx.Lock()
 	defer s.seenMtx.Unlock()
 
@@ -134,6 +257,7 @@ func (s *Store) see(u string) bool {
 	}
 
 	s.seen[u] = struct{}{}
+	s.urls[filename] = u
 	return false
 }
 
@@ -0,0 +1,150 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrOffline is the error of every request sent through an offline client.
+var ErrOffline = errors.New("network access disabled")
+
+// offlineTransport is an http.RoundTripper that fails every request.
+type offlineTransport struct{}
+
+func (offlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, ErrOffline
+}
+
+// NewOfflineClient returns an http client that fails every request with
+// ErrOffline, without touching the network.
+func NewOfflineClient() *http.Client {
+	return &http.Client{
+		Transport: offlineTransport{},
+	}
+}
+
+// HostMatches returns true if host equals pattern or is a subdomain of it.
+// The comparison ignores case and a leading dot in the pattern.
+func HostMatches(host string, pattern string) bool {
+	host = strings.ToLower(host)
+	pattern = strings.ToLower(strings.TrimPrefix(pattern, "."))
+	return host == pattern || strings.HasSuffix(host, "."+pattern)
+}
+
+// HostSettings customizes the requests sent to one host and its subdomains.
+type HostSettings struct {
+	Header    http.Header // Added to every request, replacing any values the request already has.
+	RateLimit float64     // Largest number of requests per second; 0 for no limit.
+	Proxy     *url.URL    // Proxy for requests to the host; nil to use the transport's default.
+}
+
+// Transport is an http.RoundTripper that applies per-host settings to each
+// request, including each request of a redirect chain. It is safe for
+// concurrent use.
+type Transport struct {
+	base  *http.Transport
+	proxy *url.URL                // Default proxy; nil to use the environment's.
+	hosts map[string]HostSettings // Keyed by host pattern (see HostMatches).
+
+	mtx  sync.Mutex
+	next map[string]time.Time // Host pattern -> earliest time of the next request.
+}
+
+// NewTransport returns a transport that sends requests through the given
+// proxy, or through the proxy that the environment specifies if proxy is nil,
+// and applies the given per-host settings.
+func NewTransport(proxy *url.URL, hosts map[string]HostSettings) *Transport {
+	t := &Transport{
+		proxy: proxy,
+		hosts: hosts,
+		next:  map[string]time.Time{},
+	}
+
+	t.base = http.DefaultTransport.(*http.Transport).Clone()
+	t.base.Proxy = t.proxyFor
+
+	return t
+}
+
+// settings returns the settings for the given host, and the pattern they are
+// keyed by. If several patterns match, the longest wins.
+func (t *Transport) settings(host string) (string, HostSettings, bool) {
+	var best string
+	for pattern := range t.hosts {
+		if HostMatches(host, pattern) && len(pattern) > len(best) {
+			best = pattern
+		}
+	}
+	if best == "" {
+		return "", HostSettings{}, false
+	}
+	return best, t.hosts[best], true
+}
+
+// proxyFor implements http.Transport#Proxy.
+func (t *Transport) proxyFor(req *http.Request) (*url.URL, error) {
+	if _, hs, ok := t.settings(req.URL.Hostname()); ok && hs.Proxy != nil {
+		return hs.Proxy, nil
+	}
+	if t.proxy != nil {
+		return t.proxy, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// wait blocks until the rate limit of the given host pattern permits another
+// request.
+func (t *Transport) wait(ctx context.Context, pattern string, rate float64) error {
+	interval := time.Duration(float64(time.Second) / rate)
+
+	t.mtx.Lock()
+	now := time.Now()
+	at := t.next[pattern]
+	if at.Before(now) {
+		at = now
+	}
+	t.next[pattern] = at.Add(interval)
+	t.mtx.Unlock()
+
+	d := at.Sub(now)
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	pattern, hs, ok := t.settings(req.URL.Hostname())
+	if ok {
+		if len(hs.Header) > 0 {
+			req = req.Clone(req.Context())
+			for k, vs := range hs.Header {
+				req.Header[http.CanonicalHeaderKey(k)] = vs
+			}
+		}
+
+		if hs.RateLimit > 0 {
+			err := t.wait(req.Context(), pattern, hs.RateLimit)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return t.base.RoundTrip(req)
+}
@@ -42,7 +42,9 @@ func NewContextReader(ctx context.Context, r io.Reader) *ContextReader {
 }
 
 // Read implements io.Reader#Read(), respecting the ContextReader's embedded
-// context.
+// context. It counts the bytes it reads in the context's Stats, if any.
 func (cr *ContextReader) Read(p []byte) (int, error) {
-	return ContextRead(cr.ctx, cr.r, p)
+	n, err := ContextRead(cr.ctx, cr.r, p)
+	CountBytes(cr.ctx, int64(n))
+	return n, err
 }
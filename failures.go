@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// failure is an error processing a post or one of its links, along with
+// enough context to find the culprit.
+type failure struct {
+	Src linkSource // Message the failure occurred in. CommentID is empty for post failures.
+	URL string     // Link that failed to save. Empty for post failures.
+	Err error
+}
+
+func (f *failure) Error() string {
+	sb := &strings.Builder{}
+	fmt.Fprintf(sb, "file=%s", f.Src.File)
+	if f.Src.PostID != "" {
+		fmt.Fprintf(sb, " post=%s", f.Src.PostID)
+	}
+	if f.Src.CommentID != "" {
+		fmt.Fprintf(sb, " comment=%s", f.Src.CommentID)
+	}
+	if f.URL != "" {
+		fmt.Fprintf(sb, " url=%s", f.URL)
+	}
+	fmt.Fprintf(sb, " err=%v", f.Err)
+	return sb.String()
+}
+
+func (f *failure) Unwrap() error {
+	return f.Err
+}
+
+// failures collects the errors that occur during a run and enforces the
+// configured error limit. Its methods are safe for concurrent use.
+type failures struct {
+	Posts   []*failure // Posts that could not be processed.
+	Links   []*failure // Links that could not be saved.
+	Stopped bool       // True if the run stopped early because it hit the error limit.
+
+	max    int                // Number of failures that stops the run; 0 for no limit.
+	cancel context.CancelFunc // Stops the run.
+	mtx    sync.Mutex
+}
+
+func newFailures(max int, cancel context.CancelFunc) *failures {
+	return &failures{
+		max:    max,
+		cancel: cancel,
+	}
+}
+
+// AddPost records a post that could not be processed.
+func (fs *failures) AddPost(src linkSource, err error) {
+	fs.add(&fs.Posts, &failure{Src: src, Err: err})
+}
+
+// AddLink records a link that could not be saved.
+func (fs *failures) AddLink(src linkSource, u string, err error) {
+	fs.add(&fs.Links, &failure{Src: src, URL: u, Err: err})
+}
+
+func (fs *failures) add(list *[]*failure, f *failure) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	*list = append(*list, f)
+
+	if fs.max > 0 && !fs.Stopped && len(fs.Posts)+len(fs.Links) >= fs.max {
+		log.Errorf("error limit reached; stopping: max=%d", fs.max)
+		fs.Stopped = true
+		fs.cancel()
+	}
+}
+
+// Strings returns the text of every collected failure, posts first.
+func (fs *failures) Strings() []string {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	var ss []string
+	for _, f := range fs.Posts {
+		ss = append(ss, f.Error())
+	}
+	for _, f := range fs.Links {
+		ss = append(ss, f.Error())
+	}
+	return ss
+}
+
+// Err returns nil if nothing failed. Otherwise it returns the collection
+// itself as an error summarizing what failed.
+func (fs *failures) Err() error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	if len(fs.Posts) == 0 && len(fs.Links) == 0 {
+		return nil
+	}
+	return fs
+}
+
+func (fs *failures) Error() string {
+	s := fmt.Sprintf("%d posts and %d links failed", len(fs.Posts), len(fs.Links))
+	if fs.Stopped {
+		s += "; stopped after reaching error limit"
+	}
+	return s
+}
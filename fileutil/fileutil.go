@@ -1,10 +1,14 @@
 package fileutil
 
 import (
+	"errors"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -24,6 +28,8 @@ func IsDir(filename string) bool {
 // RecursiveCopyIf conditionally copies all files rooted at srcDir to their
 // equivalent relative path rooted at dstDir. For each file, it performs a copy
 // if pred returns true. For each directory, it descends if pred retruns true.
+// It skips a file whose copy already has the same size and modification time,
+// and it gives each copy the modification time of its original.
 func RecursiveCopyIf(srcDir string, dstDir string, pred func(i os.FileInfo) bool) error {
 	absDst, err := filepath.Abs(dstDir)
 	if err != nil {
@@ -84,6 +90,13 @@ func RecursiveCopyIf(srcDir string, dstDir string, pred func(i os.FileInfo) bool
 			return nil
 		}
 
+		if dstInfo, err := os.Stat(fullDst); err == nil &&
+			dstInfo.Size() == info.Size() && dstInfo.ModTime().Equal(info.ModTime()) {
+
+			log.Debugf("skipping unchanged file: %s", fullSrc)
+			return nil
+		}
+
 		log.Debugf("copying: %s --> %s", fullSrc, fullDst)
 
 		b, err := os.ReadFile(fullSrc)
@@ -91,7 +104,12 @@ func RecursiveCopyIf(srcDir string, dstDir string, pred func(i os.FileInfo) bool
 			return err
 		}
 
-		err = os.WriteFile(fullDst, b, fs.ModePerm)
+		err = WriteFileAtomic(fullDst, b, fs.ModePerm)
+		if err != nil {
+			return err
+		}
+
+		err = os.Chtimes(fullDst, time.Now(), info.ModTime())
 		if err != nil {
 			return err
 		}
@@ -101,3 +119,122 @@ func RecursiveCopyIf(srcDir string, dstDir string, pred func(i os.FileInfo) bool
 
 	return iter("")
 }
+
+// WriteFileAtomic is like os.WriteFile, but it writes the data to a temporary
+// file in the same directory and then renames it into place. A reader never
+// sees a partially written file, even if the process dies mid-write.
+func WriteFileAtomic(filename string, data []byte, perm fs.FileMode) error {
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+
+	f, err := os.CreateTemp(dir, "."+base+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+
+	// Clean up the temporary file unless it gets renamed into place.
+	renamed := false
+	defer func() {
+		if !renamed {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(tmpPath, perm)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, filename)
+	if err != nil {
+		return err
+	}
+	renamed = true
+
+	return nil
+}
+
+// MoveFile renames src to dst. If they are on different filesystems, which
+// os.Rename can't handle, it copies src to dst atomically and then removes
+// src.
+func MoveFile(src string, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	log.Debugf("copying across filesystems: %s --> %s", src, dst)
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	dir, base := filepath.Split(dst)
+	if dir == "" {
+		dir = "."
+	}
+
+	out, err := os.CreateTemp(dir, "."+base+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := out.Name()
+
+	// Clean up the temporary file unless it gets renamed into place.
+	renamed := false
+	defer func() {
+		if !renamed {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(tmpPath, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	err = os.Chtimes(tmpPath, time.Now(), info.ModTime())
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, dst)
+	if err != nil {
+		return err
+	}
+	renamed = true
+
+	return os.Remove(src)
+}
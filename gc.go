@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/ccollins476ad/bdfrscrape/download"
+	"github.com/ccollins476ad/bdfrscrape/fileutil"
+	log "github.com/sirupsen/logrus"
+)
+
+// garbageFile is a media file that no processed post links to.
+type garbageFile struct {
+	Filename string // Relative to the destination directory.
+	Size     int64
+}
+
+// findGarbage returns the media files in destDir that no processed post links
+// to, directly or through a gallery page, and the posts that could not be
+// parsed. Attribution sidecars go with their media files. The linkPrefix
+// parameter is the prefix of the local links in posts whose prefix the
+// manifest doesn't record.
+func findGarbage(destDir string, linkPrefix string, man *download.Manifest) ([]garbageFile, []string, error) {
+	g, err := loadArchiveGraph(destDir, linkPrefix, man)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var garbage []garbageFile
+	for _, filename := range g.Media {
+		if g.Referenced[filename] {
+			continue
+		}
+
+		info, err := os.Stat(filepath.Join(destDir, filename))
+		if err != nil {
+			return nil, nil, err
+		}
+		garbage = append(garbage, garbageFile{
+			Filename: filename,
+			Size:     info.Size(),
+		})
+	}
+
+	var unreadable []string
+	for filename, err := range g.Unreadable {
+		log.WithError(err).Errorf("failed to read post: filename=%s", filename)
+		unreadable = append(unreadable, filename)
+	}
+	sort.Strings(unreadable)
+
+	return garbage, unreadable, nil
+}
+
+// collectGarbage removes the given files from destDir and from the manifest.
+// If quarantineDir is not empty, it moves the files there instead of deleting
+// them, copying them if quarantineDir is on another filesystem.
+func collectGarbage(destDir string, quarantineDir string, man *download.Manifest, garbage []garbageFile) error {
+	if quarantineDir != "" {
+		err := os.MkdirAll(quarantineDir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, f := range garbage {
+		path := filepath.Join(destDir, f.Filename)
+
+		var err error
+		if quarantineDir != "" {
+			log.Infof("quarantining %s --> %s", path, quarantineDir)
+			err = fileutil.MoveFile(path, filepath.Join(quarantineDir, f.Filename))
+		} else {
+			log.Infof("deleting %s", path)
+			err = os.Remove(path)
+		}
+		if err != nil {
+			return err
+		}
+
+		man.Remove(f.Filename)
+	}
+
+	return nil
+}
+
+// printGarbage writes a human-readable list of the given files to w.
+func printGarbage(w io.Writer, garbage []garbageFile) error {
+	if len(garbage) == 0 {
+		fmt.Fprintln(w, "No unreferenced files found.")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SIZE\tFILE")
+	var total int64
+	for _, f := range garbage {
+		fmt.Fprintf(tw, "%d\t%s\n", f.Size, f.Filename)
+		total += f.Size
+	}
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\n%d unreferenced files, %d bytes.\n", len(garbage), total)
+	return nil
+}
+
+// runGC implements the gc command: it finds the media files in a destination
+// directory that no processed post links to, and deletes or quarantines them
+// if asked.
+func runGC(cmd *command, args []string) int {
+	flags := cmd.flagSet()
+	buildLinkPrefix := bindLinkPrefixFlags(flags)
+	del := flags.Bool("delete", false, "delete the unreferenced files")
+	quarantineDir := flags.String("quarantine", "", "move the unreferenced files to `dir` instead of deleting them")
+
+	posArgs, err := parseFlags(flags, args, "dest_dir")
+	if err != nil {
+		return usageError(flags, err)
+	}
+	destDir := posArgs[0]
+
+	linkPrefix, err := buildLinkPrefix()
+	if err != nil {
+		printFatalError(err)
+		return 1
+	}
+
+	if *del && *quarantineDir != "" {
+		return usageError(flags, fmt.Errorf("-delete and -quarantine are mutually exclusive"))
+	}
+	dryRun := !*del && *quarantineDir == ""
+
+	manPath := download.ManifestPath(destDir)
+	man, err := download.LoadManifest(manPath)
+	if err != nil {
+		printFatalError(fmt.Errorf("failed to load manifest: %w", err))
+		return 3
+	}
+
+	garbage, unreadable, err := findGarbage(destDir, linkPrefix, man)
+	if err != nil {
+		printFatalError(err)
+		return 3
+	}
+
+	err = printGarbage(os.Stdout, garbage)
+	if err != nil {
+		printFatalError(err)
+		return 3
+	}
+
+	if dryRun || len(garbage) == 0 {
+		if len(garbage) > 0 {
+			fmt.Println("Rerun with -delete or -quarantine to remove them.")
+		}
+		return 0
+	}
+
+	// Media that an unreadable post links to would look unreferenced, as would
+	// media that an interrupted scrape saved for posts it hadn't written yet.
+	if len(unreadable) > 0 {
+		printFatalError(fmt.Errorf("refusing to remove files: %d posts could not be read", len(unreadable)))
+		return 3
+	}
+	if fileutil.FileExists(CheckpointPath(destDir)) {
+		printFatalError(fmt.Errorf("refusing to remove files: a scrape was interrupted; finish it first"))
+		return 3
+	}
+
+	// Save the manifest even if some files couldn't be removed, so that it
+	// forgets the ones that were.
+	err = collectGarbage(destDir, *quarantineDir, man, garbage)
+	if saveErr := man.Save(manPath); saveErr != nil && err == nil {
+		err = fmt.Errorf("failed to save manifest: %w", saveErr)
+	}
+	if err != nil {
+		printFatalError(err)
+		return 3
+	}
+
+	return 0
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/ccollins476ad/bdfrscrape/download"
+	"github.com/ccollins476ad/bdfrscrape/fileutil"
+)
+
+func TestFindGarbage(t *testing.T) {
+	destDir, man := newTestArchive(t)
+
+	garbage, unreadable, err := findGarbage(destDir, testPrefix, man)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []garbageFile{{Filename: orphanMedia, Size: int64(len("orphan"))}}
+	if !reflect.DeepEqual(garbage, want) {
+		t.Errorf("garbage=%+v, want %+v", garbage, want)
+	}
+	if len(unreadable) != 0 {
+		t.Errorf("unreadable=%q, want none", unreadable)
+	}
+}
+
+// otherDeviceDir returns a new directory on a different filesystem than
+// destDir, or skips the test if there is none.
+func otherDeviceDir(t *testing.T, destDir string) string {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("/dev/shm", "bdfrscrape-test-")
+	if err != nil {
+		t.Skipf("no second filesystem at /dev/shm: %v", err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	// Only a rename across filesystems fails with EXDEV.
+	probe := filepath.Join(destDir, "probe")
+	err = os.WriteFile(probe, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(probe)
+
+	err = os.Rename(probe, filepath.Join(dir, "probe"))
+	if !errors.Is(err, syscall.EXDEV) {
+		t.Skipf("/dev/shm is on the same filesystem as %s", destDir)
+	}
+
+	return dir
+}
+
+func TestCollectGarbage(t *testing.T) {
+	tests := []struct {
+		name       string
+		quarantine func(t *testing.T, destDir string) string
+	}{
+		{
+			name: "delete",
+			quarantine: func(t *testing.T, destDir string) string {
+				return ""
+			},
+		},
+		{
+			name: "quarantine",
+			quarantine: func(t *testing.T, destDir string) string {
+				return filepath.Join(t.TempDir(), "quarantine")
+			},
+		},
+		{
+			name: "quarantine on another filesystem",
+			quarantine: func(t *testing.T, destDir string) string {
+				return filepath.Join(otherDeviceDir(t, destDir), "quarantine")
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			destDir, man := newTestArchive(t)
+			quarantineDir := tt.quarantine(t, destDir)
+
+			garbage, _, err := findGarbage(destDir, testPrefix, man)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = collectGarbage(destDir, quarantineDir, man, garbage)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if fileutil.FileExists(filepath.Join(destDir, orphanMedia)) {
+				t.Errorf("%s is still in the destination directory", orphanMedia)
+			}
+			for _, filename := range []string{directMedia, download.SidecarFilename(directMedia), galleryPage, galleryMedia, prefixMedia} {
+				if !fileutil.FileExists(filepath.Join(destDir, filename)) {
+					t.Errorf("referenced file %s was removed", filename)
+				}
+				if _, ok := man.Lookup(filename); !ok {
+					t.Errorf("manifest lost referenced file %s", filename)
+				}
+			}
+			if _, ok := man.Lookup(orphanMedia); ok {
+				t.Errorf("manifest still lists %s", orphanMedia)
+			}
+
+			if quarantineDir != "" {
+				b, err := os.ReadFile(filepath.Join(quarantineDir, orphanMedia))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(b) != "orphan" {
+					t.Errorf("quarantined %q, want the orphan's contents", b)
+				}
+			}
+		})
+	}
+}
@@ -6,14 +6,15 @@ require (
 	github.com/flytam/filenamify v1.2.0
 	github.com/koffeinsource/go-imgur v0.4.1
 	github.com/sirupsen/logrus v1.9.3
+	golang.org/x/net v0.7.0
 	golang.org/x/sync v0.10.0
+	gopkg.in/yaml.v3 v3.0.1
 	mvdan.cc/xurls/v2 v2.6.0
 )
 
 require (
 	github.com/golang/protobuf v1.3.5 // indirect
 	github.com/koffeinsource/go-klogger v0.1.1 // indirect
-	golang.org/x/net v0.7.0 // indirect
 	golang.org/x/sys v0.28.0 // indirect
 	google.golang.org/appengine v1.6.5 // indirect
 )
@@ -2,12 +2,16 @@ package main
 
 import (
 	"context"
-	"flag"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 
 	"github.com/ccollins476ad/bdfrscrape/fileutil"
 	log "github.com/sirupsen/logrus"
@@ -18,11 +22,31 @@ func printFatalError(err error) {
 }
 
 func main() {
-	cfg, err := parseArgs()
+	args := os.Args[1:]
+
+	cmd := commands()[0]
+	if len(args) > 0 {
+		switch args[0] {
+		case "help", "-h", "-help", "--help":
+			usage()
+			return
+		}
+		if c := findCommand(args[0]); c != nil {
+			cmd = c
+			args = args[1:]
+		}
+	}
+
+	os.Exit(cmd.Run(cmd, args))
+}
+
+// runScrape implements the scrape command: it copies a bdfr archive to a
+// destination directory, saving the media that its posts link to.
+func runScrape(cmd *command, args []string) int {
+	flags := cmd.flagSet()
+	cfg, err := parseScrapeArgs(flags, args)
 	if err != nil {
-		printFatalError(err)
-		flag.Usage()
-		os.Exit(1)
+		return usageError(flags, err)
 	}
 
 	if cfg.Verbose {
@@ -38,6 +62,22 @@ func main() {
 		return nil
 	})
 
+	if cfg.DryRun {
+		plan, err := planFiles(cfg, filenames)
+		if err != nil {
+			printFatalError(err)
+			return 3
+		}
+
+		b, err := json.MarshalIndent(plan, "", "  ")
+		if err != nil {
+			printFatalError(err)
+			return 3
+		}
+		fmt.Println(string(b))
+		return 0
+	}
+
 	// Copy non-post files to destination directory. These are files that won't
 	// get processed, but which the posts reference, and thus need a manual
 	// copy (reddit media).
@@ -46,12 +86,65 @@ func main() {
 	})
 	if err != nil {
 		printFatalError(err)
-		os.Exit(2)
+		return 2
+	}
+
+	// Stop cleanly on Ctrl-C or SIGTERM: posts in progress are abandoned and
+	// the next run resumes from a checkpoint. Once the first signal arrives,
+	// restore the default behavior so that a second one kills the process.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	err = processFiles(ctx, cfg, filenames)
+	if ctx.Err() != nil {
+		printFatalError(fmt.Errorf("interrupted; rerun to resume"))
+		return 130
 	}
 
-	err = processFiles(context.Background(), cfg, filenames)
+	// An offline run only rewrites links to media already on disk. List the
+	// links that a normal run would still download.
+	if cfg.Offline {
+		pendErr := printPending(os.Stdout, cfg.DestDir)
+		if pendErr != nil {
+			printFatalError(fmt.Errorf("failed to load report: %w", pendErr))
+		}
+	}
 	if err != nil {
 		printFatalError(err)
-		os.Exit(3)
+
+		// Exit with 4 if the only failures were links; the posts themselves
+		// are all processed.
+		var fails *failures
+		if errors.As(err, &fails) && len(fails.Posts) == 0 && !fails.Stopped {
+			return 4
+		}
+		return 3
+	}
+
+	return 0
+}
+
+// printPending writes the links that the last run, an offline one, left to
+// download to w.
+func printPending(w io.Writer, destDir string) error {
+	r, err := LoadReport(destDir)
+	if err != nil {
+		return err
+	}
+
+	pending := r.Pending()
+	if len(pending) == 0 {
+		fmt.Fprintln(w, "Every supported link has local media.")
+		return nil
+	}
+
+	fmt.Fprintf(w, "%d links still need downloading:\n", len(pending))
+	for _, u := range pending {
+		fmt.Fprintf(w, "  %s\n", u)
 	}
+	return nil
 }
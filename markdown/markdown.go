@@ -0,0 +1,550 @@
+package markdown
+
+import (
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+
+	"mvdan.cc/xurls/v2"
+)
+
+// LinkKind identifies how a link is written in a markdown document.
+type LinkKind int
+
+const (
+	Bare      LinkKind = iota // A url in running text.
+	Autolink                  // A url in angle brackets: <https://...>
+	Inline                    // An inline link or image: [text](url "title")
+	Reference                 // A link reference definition: [label]: url "title"
+)
+
+// Link is a link found in a markdown document.
+type Link struct {
+	Kind LinkKind
+	URL  string // The url, with html entities and markdown escapes resolved.
+	Raw  string // The url, as written.
+
+	// Start and End delimit the bytes that a rewrite replaces. For inline
+	// links and reference definitions, this is just the destination; the text
+	// and title are left alone. For bare urls, it is the url. For autolinks,
+	// it includes the angle brackets.
+	Start int
+	End   int
+
+	// LinkEnd is the index just past the whole link construct (e.g., past
+	// the closing parenthesis of an inline link). For an image in a link's
+	// text, it is just past the enclosing link, since text inserted there
+	// can't go inside the link's text.
+	LinkEnd int
+
+	// HasTitle is true if an inline link or reference definition has a title.
+	HasTitle bool
+}
+
+// Edit describes how Rewrite changes one link.
+type Edit struct {
+	Text   string // Replaces the link's span, from Start to End.
+	Suffix string // Inserted just after the whole link construct, at LinkEnd.
+}
+
+var (
+	// fenceRegexp matches the opening or closing line of a fenced code block
+	// and captures the fence.
+	fenceRegexp = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})")
+
+	// refDefRegexp matches a link reference definition line and captures its
+	// destination.
+	refDefRegexp = regexp.MustCompile(`^ {0,3}\[(?:[^\]\\\n]|\\.)+\]:[ \t]*(<[^<>\n]*>|\S+)(?:[ \t]+("[^"\n]*"|'[^'\n]*'|\([^)\n]*\)))?[ \t]*$`)
+
+	// autolinkRegexp matches an autolink and captures its url.
+	autolinkRegexp = regexp.MustCompile(`^<([A-Za-z][A-Za-z0-9+.-]{1,31}:[^\s<>]*)>`)
+
+	// htmlTagRegexp matches an html open tag, close tag, or comment.
+	htmlTagRegexp = regexp.MustCompile(`^(?:<!--[\s\S]*?-->|</[A-Za-z][A-Za-z0-9-]*\s*>|<[A-Za-z][A-Za-z0-9-]*(?:\s+[A-Za-z_:][A-Za-z0-9_.:-]*(?:\s*=\s*(?:"[^"]*"|'[^']*'|[^\s"'=<>` + "`" + `]+))?)*\s*/?>)`)
+
+	// entityRegexp matches an html character reference.
+	entityRegexp = regexp.MustCompile(`^&(?:#[0-9]{1,7}|#[xX][0-9a-fA-F]{1,6}|[A-Za-z][A-Za-z0-9]{1,31});`)
+
+	bareRegexp = xurls.Strict()
+)
+
+// Unescape resolves the html entities (e.g., "&amp;") and markdown backslash
+// escapes (e.g., "\_") in the given text. bdfr bodies contain both inside
+// urls.
+func Unescape(s string) string {
+	if !strings.ContainsAny(s, "&\\") {
+		return s
+	}
+	plain, _, _ := unescapeMap(s)
+	return plain
+}
+
+// unescapeMap resolves the entities and escapes in s, like Unescape. It also
+// returns, for each byte of the result, the offsets in s where the construct
+// that produced the byte starts and ends.
+func unescapeMap(s string) (string, []int, []int) {
+	var sb strings.Builder
+	var starts, ends []int
+
+	emit := func(text string, start int, end int) {
+		sb.WriteString(text)
+		for range len(text) {
+			starts = append(starts, start)
+			ends = append(ends, end)
+		}
+	}
+
+	for i := 0; i < len(s); {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && isPunct(s[i+1]):
+			emit(s[i+1:i+2], i, i+2)
+			i += 2
+
+		case s[i] == '&':
+			if m := entityRegexp.FindString(s[i:]); m != "" {
+				if text := html.UnescapeString(m); text != m {
+					emit(text, i, i+len(m))
+					i += len(m)
+					continue
+				}
+			}
+			emit(s[i:i+1], i, i+1)
+			i++
+
+		default:
+			emit(s[i:i+1], i, i+1)
+			i++
+		}
+	}
+
+	return sb.String(), starts, ends
+}
+
+// Links returns the links in the given reddit-flavored markdown document, in
+// order of appearance. It ignores urls in code blocks, code spans, and html
+// tags, and it does not look for bare urls inside link text.
+func Links(doc string) []Link {
+	sc := &scanner{doc: doc}
+
+	regionStart := 0
+	inFence := ""
+	prevBlank := true
+	prevIndented := false
+
+	// Split the document into regions of non-code lines. Scan each region for
+	// inline links.
+	for lineStart := 0; lineStart < len(doc); {
+		lineEnd := strings.IndexByte(doc[lineStart:], '\n')
+		if lineEnd == -1 {
+			lineEnd = len(doc)
+		} else {
+			lineEnd += lineStart + 1
+		}
+		line := strings.TrimRight(doc[lineStart:lineEnd], "\r\n")
+		blank := strings.TrimSpace(line) == ""
+
+		if inFence != "" {
+			if m := fenceRegexp.FindStringSubmatch(line); m != nil && m[1][0] == inFence[0] && len(m[1]) >= len(inFence) {
+				inFence = ""
+			}
+			regionStart = lineEnd
+		} else if m := fenceRegexp.FindStringSubmatch(line); m != nil {
+			sc.scanRegion(regionStart, lineStart)
+			inFence = m[1]
+			regionStart = lineEnd
+		} else if indented := strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t"); indented && !blank && (prevBlank || prevIndented) {
+			sc.scanRegion(regionStart, lineStart)
+			prevIndented = true
+			regionStart = lineEnd
+		} else if !blank {
+			prevIndented = false
+		}
+
+		prevBlank = blank
+		lineStart = lineEnd
+	}
+
+	if inFence == "" {
+		sc.scanRegion(regionStart, len(doc))
+	}
+
+	return sc.links
+}
+
+// Rewrite edits the given links in a markdown document. The links must be in
+// order of appearance, as Links returns them. For each link, fn returns the
+// edit to apply and true, or false to leave the link unchanged. Suffixes
+// inserted at the same index appear in the order of their links.
+func Rewrite(doc string, links []Link, fn func(l Link) (Edit, bool)) string {
+	// A replacement of doc[start:end] with text. Suffixes replace empty
+	// ranges.
+	type op struct {
+		start int
+		end   int
+		text  string
+	}
+
+	var ops []op
+	for _, l := range links {
+		e, ok := fn(l)
+		if !ok {
+			continue
+		}
+		ops = append(ops, op{l.Start, l.End, e.Text})
+		if e.Suffix != "" {
+			ops = append(ops, op{l.LinkEnd, l.LinkEnd, e.Suffix})
+		}
+	}
+
+	// The suffix of an image in a link's text comes after the enclosing
+	// link's destination.
+	sort.SliceStable(ops, func(i, j int) bool {
+		return ops[i].start < ops[j].start
+	})
+
+	var sb strings.Builder
+
+	prev := 0
+	for _, o := range ops {
+		sb.WriteString(doc[prev:o.start])
+		sb.WriteString(o.text)
+		prev = o.end
+	}
+	sb.WriteString(doc[prev:])
+
+	return sb.String()
+}
+
+// scanner finds the links in a markdown document.
+type scanner struct {
+	doc   string
+	links []Link
+}
+
+// isPunct returns true if c is an ascii punctuation character, i.e., one that
+// a backslash can escape.
+func isPunct(c byte) bool {
+	return strings.IndexByte("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", c) >= 0
+}
+
+// addBare adds the bare urls in the plain text between start and end. It
+// searches the text with entities and escapes resolved, so that a url
+// containing "&amp;" or "\_" is found whole. Each link's span covers the url
+// as written.
+func (sc *scanner) addBare(start int, end int) {
+	if start >= end {
+		return
+	}
+
+	plain, starts, ends := unescapeMap(sc.doc[start:end])
+	for _, loc := range bareRegexp.FindAllStringIndex(plain, -1) {
+		ls := start + starts[loc[0]]
+		le := start + ends[loc[1]-1]
+		sc.links = append(sc.links, Link{
+			Kind:    Bare,
+			URL:     plain[loc[0]:loc[1]],
+			Raw:     sc.doc[ls:le],
+			Start:   ls,
+			End:     le,
+			LinkEnd: le,
+		})
+	}
+}
+
+// addLink adds a non-bare link. The url, as written, occupies
+// doc[urlStart:urlEnd], a rewrite replaces doc[spanStart:spanEnd], and the
+// whole construct ends at linkEnd.
+func (sc *scanner) addLink(kind LinkKind, urlStart int, urlEnd int, spanStart int, spanEnd int, linkEnd int, hasTitle bool) {
+	raw := sc.doc[urlStart:urlEnd]
+	sc.links = append(sc.links, Link{
+		Kind:     kind,
+		URL:      Unescape(raw),
+		Raw:      raw,
+		Start:    spanStart,
+		End:      spanEnd,
+		LinkEnd:  linkEnd,
+		HasTitle: hasTitle,
+	})
+}
+
+// codeSpanEnd returns the index just past the code span that starts with the
+// backtick run at i. It returns false if the run is unmatched, in which case
+// the run is literal text.
+func (sc *scanner) codeSpanEnd(i int, end int) (int, bool) {
+	n := 0
+	for i+n < end && sc.doc[i+n] == '`' {
+		n++
+	}
+
+	for j := i + n; j < end; {
+		if sc.doc[j] != '`' {
+			j++
+			continue
+		}
+		m := 0
+		for j+m < end && sc.doc[j+m] == '`' {
+			m++
+		}
+		if m == n {
+			return j + m, true
+		}
+		j += m
+	}
+
+	return i + n, false
+}
+
+// lineEnd returns the index of the end of the line containing i, excluding
+// the newline.
+func (sc *scanner) lineEnd(i int, end int) int {
+	j := strings.IndexByte(sc.doc[i:end], '\n')
+	if j == -1 {
+		return end
+	}
+	return i + j
+}
+
+// scanRegion finds the links in the given range of non-code lines.
+func (sc *scanner) scanRegion(start int, end int) {
+	textStart := start
+	atLineStart := true
+
+	for i := start; i < end; {
+		if atLineStart {
+			atLineStart = false
+			le := sc.lineEnd(i, end)
+			if m := refDefRegexp.FindStringSubmatchIndex(sc.doc[i:le]); m != nil {
+				sc.addBare(textStart, i)
+				ds, de := i+m[2], i+m[3]
+				if sc.doc[ds] == '<' {
+					ds, de = ds+1, de-1
+				}
+				sc.addLink(Reference, ds, de, ds, de, i+m[1], m[4] != -1)
+				i = le
+				textStart = i
+				continue
+			}
+		}
+
+		switch c := sc.doc[i]; {
+		case c == '\n':
+			atLineStart = true
+			i++
+
+		case c == '\\':
+			if i+1 < end && isPunct(sc.doc[i+1]) {
+				i += 2
+			} else {
+				i++
+			}
+
+		case c == '`':
+			next, ok := sc.codeSpanEnd(i, end)
+			if ok {
+				sc.addBare(textStart, i)
+				textStart = next
+			}
+			i = next
+
+		case c == '<':
+			if m := autolinkRegexp.FindStringSubmatchIndex(sc.doc[i:end]); m != nil {
+				sc.addBare(textStart, i)
+				sc.addLink(Autolink, i+m[2], i+m[3], i, i+m[1], i+m[1], false)
+				i += m[1]
+				textStart = i
+			} else if m := htmlTagRegexp.FindStringIndex(sc.doc[i:end]); m != nil {
+				sc.addBare(textStart, i)
+				i += m[1]
+				textStart = i
+			} else {
+				i++
+			}
+
+		case c == '[' || (c == '!' && i+1 < end && sc.doc[i+1] == '['):
+			il, ok := sc.inlineLink(i, end)
+			if ok {
+				sc.addBare(textStart, i)
+				if c == '[' {
+					// A link's text may hold an image, e.g.,
+					// [![alt](img)](link).
+					sc.scanLinkText(i+1, il.textEnd, il.end)
+				}
+				sc.addLink(Inline, il.destStart, il.destEnd, il.destStart, il.destEnd, il.end, il.hasTitle)
+				i = il.end
+				textStart = i
+			} else {
+				i++
+			}
+
+		default:
+			i++
+		}
+	}
+
+	sc.addBare(textStart, end)
+}
+
+// scanLinkText finds the images in the given range of a link's text. It
+// ignores bare urls, as they aren't links there. The linkEnd parameter is the
+// index just past the enclosing link, which becomes each image's LinkEnd.
+func (sc *scanner) scanLinkText(start int, end int, linkEnd int) {
+	for i := start; i < end; {
+		switch c := sc.doc[i]; {
+		case c == '\\':
+			if i+1 < end && isPunct(sc.doc[i+1]) {
+				i += 2
+			} else {
+				i++
+			}
+
+		case c == '`':
+			i, _ = sc.codeSpanEnd(i, end)
+
+		case c == '!' && i+1 < end && sc.doc[i+1] == '[':
+			il, ok := sc.inlineLink(i, end)
+			if ok {
+				sc.addLink(Inline, il.destStart, il.destEnd, il.destStart, il.destEnd, linkEnd, il.hasTitle)
+				i = il.end
+			} else {
+				i++
+			}
+
+		default:
+			i++
+		}
+	}
+}
+
+// inlineSpan describes an inline link or image parsed by inlineLink.
+type inlineSpan struct {
+	textEnd   int  // Index of the bracket that closes the link text.
+	destStart int  // Start of the destination.
+	destEnd   int  // End of the destination.
+	end       int  // Index just past the closing parenthesis.
+	hasTitle  bool // True if the link has a title.
+}
+
+// inlineLink parses the inline link or image that starts at i.
+func (sc *scanner) inlineLink(i int, end int) (inlineSpan, bool) {
+	doc := sc.doc
+
+	j := i
+	if doc[j] == '!' {
+		j++
+	}
+
+	// Find the bracket that closes the link text.
+	depth := 0
+	for j < end {
+		c := doc[j]
+		if c == '\\' && j+1 < end && isPunct(doc[j+1]) {
+			j += 2
+			continue
+		}
+		if c == '`' {
+			next, ok := sc.codeSpanEnd(j, end)
+			if ok {
+				j = next
+				continue
+			}
+		}
+		if c == '\n' && strings.TrimSpace(doc[j+1:sc.lineEnd(j+1, end)]) == "" {
+			// Link text cannot span paragraphs.
+			return inlineSpan{}, false
+		}
+		if c == '[' {
+			depth++
+		} else if c == ']' {
+			depth--
+			if depth == 0 {
+				break
+			}
+		}
+		j++
+	}
+	if j >= end || j+1 >= end || doc[j+1] != '(' {
+		return inlineSpan{}, false
+	}
+	textEnd := j
+	j += 2
+
+	skipSpace := func() {
+		for j < end && (doc[j] == ' ' || doc[j] == '\t' || doc[j] == '\n') {
+			j++
+		}
+	}
+
+	// Parse the destination.
+	skipSpace()
+	var ds, de int
+	if j < end && doc[j] == '<' {
+		ds = j + 1
+		for j++; j < end && doc[j] != '>'; j++ {
+			if doc[j] == '\n' || doc[j] == '<' {
+				return inlineSpan{}, false
+			}
+			if doc[j] == '\\' && j+1 < end && isPunct(doc[j+1]) {
+				j++
+			}
+		}
+		if j >= end {
+			return inlineSpan{}, false
+		}
+		de = j
+		j++
+	} else {
+		ds = j
+		parens := 0
+	dest:
+		for ; j < end; j++ {
+			switch c := doc[j]; {
+			case c == '\\' && j+1 < end && isPunct(doc[j+1]):
+				j++
+			case c == '(':
+				parens++
+			case c == ')':
+				if parens == 0 {
+					break dest
+				}
+				parens--
+			case c <= ' ':
+				break dest
+			}
+		}
+		de = j
+	}
+
+	// Parse the optional title.
+	skipSpace()
+	hasTitle := false
+	if j < end && (doc[j] == '"' || doc[j] == '\'' || doc[j] == '(') && j > de {
+		closer := doc[j]
+		if closer == '(' {
+			closer = ')'
+		}
+		for j++; j < end && doc[j] != closer; j++ {
+			if doc[j] == '\\' && j+1 < end {
+				j++
+			}
+		}
+		if j >= end {
+			return inlineSpan{}, false
+		}
+		j++
+		skipSpace()
+		hasTitle = true
+	}
+
+	if j >= end || doc[j] != ')' || ds == de {
+		return inlineSpan{}, false
+	}
+
+	return inlineSpan{
+		textEnd:   textEnd,
+		destStart: ds,
+		destEnd:   de,
+		end:       j + 1,
+		hasTitle:  hasTitle,
+	}, true
+}
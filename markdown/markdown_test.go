@@ -0,0 +1,83 @@
+package markdown
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+var kindNames = map[LinkKind]string{
+	Bare:      "bare",
+	Autolink:  "autolink",
+	Inline:    "inline",
+	Reference: "reference",
+}
+
+// render describes the links that Links finds in doc, followed by the
+// document as Rewrite leaves it when each link points to "local/<n>" and is
+// followed by the suffix "{n}".
+func render(doc string) string {
+	links := Links(doc)
+
+	sb := &strings.Builder{}
+	for i, l := range links {
+		fmt.Fprintf(sb, "%d %s url=%q raw=%q title=%v\n", i+1, kindNames[l.Kind], l.URL, l.Raw, l.HasTitle)
+	}
+	sb.WriteString("---\n")
+
+	n := 0
+	sb.WriteString(Rewrite(doc, links, func(l Link) (Edit, bool) {
+		n++
+		return Edit{
+			Text:   fmt.Sprintf("local/%d", n),
+			Suffix: fmt.Sprintf("{%d}", n),
+		}, true
+	}))
+
+	return sb.String()
+}
+
+// TestGolden compares the links found in, and the rewrite of, each
+// testdata/*.md file with the matching .golden file. Run with -update to
+// regenerate the golden files.
+func TestGolden(t *testing.T) {
+	inputs, err := filepath.Glob("testdata/*.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) == 0 {
+		t.Fatal("no test inputs")
+	}
+
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), ".md")
+		t.Run(name, func(t *testing.T) {
+			doc, err := os.ReadFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := render(string(doc))
+
+			golden := strings.TrimSuffix(input, ".md") + ".golden"
+			if *update {
+				err := os.WriteFile(golden, []byte(got), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("mismatch for %s\n--- got:\n%s\n--- want:\n%s", input, got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package commons
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ccollins476ad/bdfrscrape/download"
+	"github.com/ccollins476ad/bdfrscrape/web"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	pagePrefix   = "https://commons.wikimedia.org/wiki/File:"
+	directPrefix = "https://upload.wikimedia.org/"
+	apiURL       = "https://commons.wikimedia.org/w/api.php"
+)
+
+// getHeader identifies bdfrscrape to the Wikimedia API, as its usage policy
+// requires.
+var getHeader = http.Header{
+	"user-agent": {"bdfrscrape (https://github.com/ccollins476ad/bdfrscrape)"},
+}
+
+type metadataValue struct {
+	Value string `json:"value"`
+}
+
+type imageInfo struct {
+	URL            string                   `json:"url"`
+	DescriptionURL string                   `json:"descriptionurl"`
+	ExtMetadata    map[string]metadataValue `json:"extmetadata"`
+}
+
+type queryResponse struct {
+	Query struct {
+		Pages map[string]struct {
+			Title     string      `json:"title"`
+			ImageInfo []imageInfo `json:"imageinfo"`
+		} `json:"pages"`
+	} `json:"query"`
+}
+
+// Downloader retrieves files from Wikimedia Commons. It saves an attribution
+// sidecar next to each file it resolves from a file page. It implements the
+// media.Downloader interface.
+type Downloader struct {
+	s *download.Store
+}
+
+func NewDownloader(s *download.Store) *Downloader {
+	return &Downloader{
+		s: s,
+	}
+}
+
+// Download retrieves Commons media from the given url. It can download file
+// description pages and direct upload.wikimedia.org links. See
+// media.Downloader#Download for API details.
+func (dl *Downloader) Download(ctx context.Context, u string) (string, error) {
+	if strings.HasPrefix(u, directPrefix) {
+		return dl.s.Download(ctx, u, nil)
+	}
+	if strings.HasPrefix(u, pagePrefix) {
+		return dl.downloadPage(ctx, u)
+	}
+	return "", nil
+}
+
+// Claims returns true if url=u is a Commons file page or a direct
+// upload.wikimedia.org link. See media.Downloader#Claims.
+func (dl *Downloader) Claims(u string) bool {
+	return strings.HasPrefix(u, directPrefix) || strings.HasPrefix(u, pagePrefix)
+}
+
+// fileTitle extracts the file title (e.g., "File:Example.jpg") from the url
+// of a Commons file page.
+func fileTitle(u string) (string, error) {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(pu.Path, "/wiki/"), nil
+}
+
+// queryImageInfo asks the Commons API for the original file url and metadata
+// of the file with the given title.
+func (dl *Downloader) queryImageInfo(ctx context.Context, title string) (*imageInfo, error) {
+	q := url.Values{}
+	q.Set("action", "query")
+	q.Set("format", "json")
+	q.Set("prop", "imageinfo")
+	q.Set("iiprop", "url|extmetadata")
+	q.Set("titles", title)
+
+	b, err := download.Get(ctx, dl.s.HTTPClient(), apiURL+"?"+q.Encode(), getHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	qr := &queryResponse{}
+	err = json.Unmarshal(b, qr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode commons api response: %w", err)
+	}
+
+	for _, p := range qr.Query.Pages {
+		if len(p.ImageInfo) > 0 && p.ImageInfo[0].URL != "" {
+			return &p.ImageInfo[0], nil
+		}
+	}
+
+	return nil, fmt.Errorf("commons file not found: title=%s", title)
+}
+
+// attribution converts Commons file metadata into an attribution. Commons
+// metadata values may contain html markup, which is removed.
+func attribution(pageURL string, title string, ii *imageInfo) *download.Attribution {
+	meta := func(key string) string {
+		return web.PlainText(ii.ExtMetadata[key].Value)
+	}
+
+	a := &download.Attribution{
+		Source:     pageURL,
+		Title:      meta("ObjectName"),
+		Author:     meta("Artist"),
+		License:    meta("LicenseShortName"),
+		LicenseURL: meta("LicenseUrl"),
+		Credit:     meta("Credit"),
+	}
+	if a.Title == "" {
+		a.Title = strings.TrimPrefix(title, "File:")
+	}
+
+	return a
+}
+
+// downloadPage downloads the original file described by the given Commons file
+// page, along with an attribution sidecar.
+func (dl *Downloader) downloadPage(ctx context.Context, u string) (string, error) {
+	desc, err := dl.s.EvaluateURL(u)
+	if err != nil {
+		return "", err
+	}
+
+	if desc.IsLocal {
+		// Already downloaded.
+		return desc.Filename, nil
+	}
+
+	title, err := fileTitle(u)
+	if err != nil {
+		return "", err
+	}
+
+	ii, err := dl.queryImageInfo(ctx, title)
+	if err != nil {
+		return "", err
+	}
+
+	log.Debugf("resolved commons file page: %s --> %s", u, ii.URL)
+
+	filename, err := dl.s.DownloadAs(ctx, ii.URL, getHeader, desc.Filename)
+	if err != nil {
+		return "", err
+	}
+
+	err = dl.s.SaveAttribution(filename, attribution(u, title, ii))
+	if err != nil {
+		return "", err
+	}
+
+	return filename, nil
+}
@@ -0,0 +1,132 @@
+package direct
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/ccollins476ad/bdfrscrape/download"
+	"github.com/ccollins476ad/bdfrscrape/media"
+	log "github.com/sirupsen/logrus"
+)
+
+// mediaExts is the set of filename extensions that indicate a direct link to
+// a media file.
+var mediaExts = map[string]struct{}{
+	".jpg":  {},
+	".jpeg": {},
+	".png":  {},
+	".gif":  {},
+	".webp": {},
+	".mp4":  {},
+}
+
+// Downloader retrieves media files from arbitrary hosts. It is a fallback for
+// links that no host-specific downloader claims. It implements the
+// media.Downloader interface.
+type Downloader struct {
+	s       *download.Store
+	hf      media.HostFilter
+	maxSize int64 // Maximum size of a media file, in bytes.
+}
+
+func NewDownloader(s *download.Store, hf media.HostFilter, maxSize int64) *Downloader {
+	return &Downloader{
+		s:       s,
+		hf:      hf,
+		maxSize: maxSize,
+	}
+}
+
+// hasMediaExt returns true if the path of url=u ends with a media filename
+// extension.
+func hasMediaExt(u string) bool {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+	_, ok := mediaExts[strings.ToLower(path.Ext(pu.Path))]
+	return ok
+}
+
+// isMediaType returns true if the given Content-Type header value describes an
+// image or video.
+func isMediaType(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mt, "image/") || strings.HasPrefix(mt, "video/")
+}
+
+// probe returns the response header for url=u, without its body. It tries a
+// HEAD request first. Some hosts reject HEAD (e.g., with 403 or 405) or fail
+// it outright while serving GET fine, so if HEAD fails, it falls back to a
+// GET whose body it closes unread.
+func (dl *Downloader) probe(ctx context.Context, u string) (*http.Response, error) {
+	rsp, err := download.Head(ctx, dl.s.HTTPClient(), u, nil)
+	if err == nil || ctx.Err() != nil {
+		return rsp, err
+	}
+
+	log.Debugf("head probe failed; probing with get: url=%s err=%v", u, err)
+
+	rsp, err = download.GetResponse(ctx, dl.s.HTTPClient(), u, nil)
+	if err != nil {
+		return nil, err
+	}
+	rsp.Body.Close()
+
+	return rsp, nil
+}
+
+// Download retrieves a media file from the given url if the url's host is
+// permitted and a probe indicates that the url points to an image or
+// video no larger than the configured size cap. See media.Downloader#Download
+// for API details.
+func (dl *Downloader) Download(ctx context.Context, u string) (string, error) {
+	if !dl.hf.Permits(u) {
+		return "", nil
+	}
+
+	if filename, ok := dl.s.Lookup(u); ok {
+		// Already downloaded.
+		return filename, nil
+	}
+
+	// A link with a media extension is assumed to be media, so failures are
+	// reported. Other links are only probed; failure means "not media".
+	claimed := hasMediaExt(u)
+
+	rsp, err := dl.probe(ctx, u)
+	if err != nil {
+		if claimed {
+			return "", err
+		}
+		log.Debugf("ignoring unprobeable link: url=%s err=%v", u, err)
+		return "", nil
+	}
+
+	ct := rsp.Header.Get("Content-Type")
+	if !isMediaType(ct) && !(claimed && !strings.HasPrefix(ct, "text/")) {
+		log.Debugf("ignoring non-media link: url=%s content_type=%s", u, ct)
+		return "", nil
+	}
+
+	if dl.maxSize > 0 && rsp.ContentLength > dl.maxSize {
+		return "", fmt.Errorf("media file exceeds size cap: size=%d cap=%d", rsp.ContentLength, dl.maxSize)
+	}
+
+	return dl.s.DownloadLimited(ctx, u, nil, "", dl.maxSize)
+}
+
+// Claims returns true if url=u is on a permitted host and has a media filename
+// extension. Download also probes other links, but whether it saves them
+// depends on the response. See media.Downloader#Claims.
+func (dl *Downloader) Claims(u string) bool {
+	return dl.hf.Permits(u) && hasMediaExt(u)
+}
@@ -1,6 +1,9 @@
 package media
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 // Downloader retrieves media from the web and saves it to disk. Most
 // downloader implementations only know how to access a particular web site
@@ -11,4 +14,26 @@ type Downloader interface {
 	// downloaded). It returns the path of the saved file, relative to the
 	// downloader's base directory.
 	Download(ctx context.Context, u string) (string, error)
+
+	// Claims returns true if Download would try to save url=u, judging by
+	// the url alone. It performs no network I/O. Downloaders that must fetch
+	// a link before deciding whether it is media only claim the links they
+	// can recognize without fetching.
+	Claims(u string) bool
+}
+
+// Canonicalizer is implemented by downloaders that save the media of some
+// links under a different url than the link itself (e.g., a normalized form).
+type Canonicalizer interface {
+	// CanonicalURL returns the url that Download saves the media of url=u
+	// under, or u itself. It performs no network I/O.
+	CanonicalURL(u string) string
+}
+
+// Timed is implemented by downloaders whose downloads need a different time
+// limit than the default that callers apply to each Download call.
+type Timed interface {
+	// Timeout returns the time limit for the call to Download that saves
+	// url=u, or 0 for the caller's default.
+	Timeout(u string) time.Duration
 }
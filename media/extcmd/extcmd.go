@@ -0,0 +1,269 @@
+package extcmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ccollins476ad/bdfrscrape/download"
+	"github.com/ccollins476ad/bdfrscrape/web"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Rule sends urls that match a pattern to an external command.
+type Rule struct {
+	Pattern *regexp.Regexp // Urls that the command handles.
+	Command []string       // Executable followed by any leading arguments.
+}
+
+// ParseRule parses a rule of the form "<regexp>=<command> [arg]...". Both
+// the regexp and the arguments may contain "=": the separator is the last "="
+// before the first space, so the regexp can't contain a space (write \s or
+// \x20 instead) and the executable's name can't contain "=".
+func ParseRule(s string) (Rule, error) {
+	head, _, _ := strings.Cut(s, " ")
+	i := strings.LastIndex(head, "=")
+	if i < 0 {
+		return Rule{}, fmt.Errorf("invalid external command rule: want <regexp>=<command>, have %q", s)
+	}
+
+	return newRule(s[:i], strings.Fields(s[i+1:]))
+}
+
+// newRule returns a rule that sends urls matching the given pattern to the
+// given command.
+func newRule(pattern string, command []string) (Rule, error) {
+	rx, err := regexp.Compile(pattern)
+	if err != nil {
+		return Rule{}, fmt.Errorf("invalid external command pattern: %w", err)
+	}
+
+	if len(command) == 0 || command[0] == "" {
+		return Rule{}, fmt.Errorf("external command rule lacks command: pattern=%s", pattern)
+	}
+
+	return Rule{
+		Pattern: rx,
+		Command: command,
+	}, nil
+}
+
+// String returns the rule in the form that ParseRule accepts.
+func (r Rule) String() string {
+	return r.Pattern.String() + "=" + strings.Join(r.Command, " ")
+}
+
+// yamlRule is a rule as it appears in a configuration file. Unlike the flag
+// form, it leaves no doubt where the pattern ends, and command arguments may
+// contain spaces.
+type yamlRule struct {
+	Pattern string   `yaml:"pattern"` // Regexp of the urls that the command handles.
+	Command []string `yaml:"command"` // Executable followed by any leading arguments.
+}
+
+// MarshalYAML implements yaml.Marshaler.
+func (r Rule) MarshalYAML() (interface{}, error) {
+	return yamlRule{
+		Pattern: r.Pattern.String(),
+		Command: r.Command,
+	}, nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler. It accepts a mapping with a
+// "pattern" string and a "command" list.
+func (r *Rule) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: external command rule must be a mapping with pattern and command fields", value.Line)
+	}
+	for i := 0; i < len(value.Content); i += 2 {
+		switch k := value.Content[i]; k.Value {
+		case "pattern", "command":
+		default:
+			return fmt.Errorf("line %d: unknown external command rule field: %s", k.Line, k.Value)
+		}
+	}
+
+	var yr yamlRule
+	err := value.Decode(&yr)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := newRule(yr.Pattern, yr.Command)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", value.Line, err)
+	}
+	*r = parsed
+	return nil
+}
+
+// output is the json document that an external command writes to stdout.
+type output struct {
+	Files []string `json:"files"` // Paths of produced files, absolute or relative to the destination directory.
+}
+
+// Downloader delegates downloads to external executables (e.g., a yt-dlp
+// wrapper). For a url that matches a rule, it runs the rule's command with two
+// extra arguments: the url and the path of an empty destination directory.
+// The command saves its files to the destination directory and prints a json
+// object to stdout:
+//
+//	{"files": ["video.mp4", "thumb.jpg"]}
+//
+// It implements the media.Downloader and media.Timed interfaces.
+type Downloader struct {
+	s       *download.Store
+	rules   []Rule
+	timeout time.Duration
+}
+
+func NewDownloader(s *download.Store, rules []Rule, timeout time.Duration) *Downloader {
+	return &Downloader{
+		s:       s,
+		rules:   rules,
+		timeout: timeout,
+	}
+}
+
+// Timeout implements media.Timed#Timeout. External commands typically take
+// much longer than a single http request.
+func (dl *Downloader) Timeout(u string) time.Duration {
+	return dl.timeout
+}
+
+// Download runs the external command of the first rule that matches the given
+// url. If the command produces one file, it returns the path of that file. If
+// the command produces several files, it builds an html gallery and returns
+// its path. See media.Downloader#Download for API details.
+func (dl *Downloader) Download(ctx context.Context, u string) (string, error) {
+	for _, r := range dl.rules {
+		if r.Pattern.MatchString(u) {
+			return dl.run(ctx, r, u)
+		}
+	}
+	return "", nil
+}
+
+// Claims returns true if url=u matches one of the downloader's rules. See
+// media.Downloader#Claims.
+func (dl *Downloader) Claims(u string) bool {
+	for _, r := range dl.rules {
+		if r.Pattern.MatchString(u) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveOutput converts a path from the command's output into an absolute
+// path. It returns an error if the path lies outside the destination
+// directory.
+func resolveOutput(dir string, p string) (string, error) {
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(dir, p)
+	}
+	p = filepath.Clean(p)
+
+	rel, err := filepath.Rel(dir, p)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("external command produced file outside destination directory: %s", p)
+	}
+
+	return p, nil
+}
+
+// run executes the given rule's command for url=u and imports the files it
+// produces into the store.
+func (dl *Downloader) run(ctx context.Context, r Rule, u string) (string, error) {
+	desc, err := dl.s.EvaluateURL(u)
+	if err != nil {
+		return "", err
+	}
+
+	if desc.IsLocal {
+		// Already downloaded.
+		return desc.Filename, nil
+	}
+
+	dir, err := dl.s.TempDir()
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	args := append(append([]string{}, r.Command[1:]...), u, dir)
+	cmd := exec.CommandContext(ctx, r.Command[0], args...)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	log.Debugf("running external command: %s %s", r.Command[0], strings.Join(args, " "))
+
+	err = cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("external command failed: cmd=%s err=%w stderr=%q", r.Command[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	out := output{}
+	err = json.Unmarshal(stdout.Bytes(), &out)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode external command output: cmd=%s err=%w", r.Command[0], err)
+	}
+	if len(out.Files) == 0 {
+		return "", fmt.Errorf("external command produced 0 files: cmd=%s", r.Command[0])
+	}
+
+	var filenames []string
+	for i, f := range out.Files {
+		src, err := resolveOutput(dir, f)
+		if err != nil {
+			return "", err
+		}
+
+		// The gallery, if any, takes the name derived from the url. The
+		// files get numbered variants of it.
+		filename := desc.Filename
+		if len(out.Files) > 1 {
+			filename = fmt.Sprintf("%s_%d", desc.Filename, i)
+		}
+		filename += strings.ToLower(path.Ext(src))
+
+		info, err := os.Stat(src)
+		if err != nil {
+			return "", err
+		}
+		download.CountBytes(ctx, info.Size())
+
+		err = dl.s.ImportFile(filename, src)
+		if err != nil {
+			return "", err
+		}
+		filenames = append(filenames, filename)
+	}
+
+	if len(filenames) == 1 {
+		dl.s.Manifest().Update(filenames[0], func(e *download.ManifestEntry) {
+			e.URL = u
+		})
+		return filenames[0], nil
+	}
+
+	gallery := web.BuildGallery(u, filenames)
+
+	err = dl.s.SaveFile(desc.Filename, []byte(gallery))
+	if err != nil {
+		return "", err
+	}
+
+	return desc.Filename, nil
+}
@@ -0,0 +1,311 @@
+package filedrop
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ccollins476ad/bdfrscrape/download"
+	"github.com/ccollins476ad/bdfrscrape/web"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/html"
+)
+
+var (
+	// catboxFileRegexp matches a direct catbox or litterbox file link.
+	catboxFileRegexp = regexp.MustCompile(`^https://(files|litter)\.catbox\.moe/[^/?#]+$`)
+
+	// catboxAlbumRegexp matches a catbox album page.
+	catboxAlbumRegexp = regexp.MustCompile(`^https://catbox\.moe/c/[A-Za-z0-9]+/?$`)
+
+	// pixeldrainFileRegexp matches a pixeldrain file share page or api link
+	// and captures the file id.
+	pixeldrainFileRegexp = regexp.MustCompile(`^https://pixeldrain\.com/(?:u|api/file)/([A-Za-z0-9]+)/?$`)
+
+	// pixeldrainListRegexp matches a pixeldrain list page and captures the
+	// list id.
+	pixeldrainListRegexp = regexp.MustCompile(`^https://pixeldrain\.com/l/([A-Za-z0-9]+)/?$`)
+)
+
+type pixeldrainFileInfo struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type pixeldrainList struct {
+	Success bool                 `json:"success"`
+	Files   []pixeldrainFileInfo `json:"files"`
+}
+
+// Downloader retrieves files from file-drop hosts: catbox.moe, litterbox, and
+// pixeldrain. It records each file's original upload name in the manifest. It
+// implements the media.Downloader interface.
+type Downloader struct {
+	s       *download.Store
+	maxSize int64         // Maximum size of a dropped file, in bytes.
+	timeout time.Duration // Time limit for saving one link.
+}
+
+func NewDownloader(s *download.Store, maxSize int64, timeout time.Duration) *Downloader {
+	return &Downloader{
+		s:       s,
+		maxSize: maxSize,
+		timeout: timeout,
+	}
+}
+
+// Timeout implements media.Timed#Timeout. Dropped files are often videos and
+// archives much larger than typical media, and albums and lists hold several.
+func (dl *Downloader) Timeout(u string) time.Duration {
+	return dl.timeout
+}
+
+// Download retrieves file-drop media from the given url. It can download
+// direct file links, catbox albums, pixeldrain share pages, and pixeldrain
+// lists. See media.Downloader#Download for API details.
+func (dl *Downloader) Download(ctx context.Context, u string) (string, error) {
+	if catboxFileRegexp.MatchString(u) {
+		return dl.downloadCatboxFile(ctx, u)
+	}
+	if catboxAlbumRegexp.MatchString(u) {
+		return dl.downloadCatboxAlbum(ctx, u)
+	}
+	if matches := pixeldrainFileRegexp.FindStringSubmatch(u); matches != nil {
+		return dl.downloadPixeldrainFile(ctx, matches[1])
+	}
+	if matches := pixeldrainListRegexp.FindStringSubmatch(u); matches != nil {
+		return dl.downloadPixeldrainList(ctx, u, matches[1])
+	}
+	return "", nil
+}
+
+// Claims returns true if url=u is a catbox, litterbox, or pixeldrain link. See
+// media.Downloader#Claims.
+func (dl *Downloader) Claims(u string) bool {
+	return catboxFileRegexp.MatchString(u) ||
+		catboxAlbumRegexp.MatchString(u) ||
+		pixeldrainFileRegexp.MatchString(u) ||
+		pixeldrainListRegexp.MatchString(u)
+}
+
+// CanonicalURL returns the share page url that Download saves the pixeldrain
+// file at url=u under, whether u is a share page or an api link. See
+// media.Canonicalizer#CanonicalURL.
+func (dl *Downloader) CanonicalURL(u string) string {
+	if matches := pixeldrainFileRegexp.FindStringSubmatch(u); matches != nil {
+		return pixeldrainShareURL(matches[1])
+	}
+	return u
+}
+
+// recordName notes the given file's source url and, if known, original upload
+// name in the manifest.
+func (dl *Downloader) recordName(filename string, u string, name string) {
+	dl.s.Manifest().Update(filename, func(e *download.ManifestEntry) {
+		e.URL = u
+		if name != "" {
+			e.OriginalName = name
+		}
+	})
+}
+
+// downloadCatboxFile downloads a direct catbox or litterbox file link. Catbox
+// does not reveal the name a file was uploaded with, so the name in the link
+// is recorded instead.
+func (dl *Downloader) downloadCatboxFile(ctx context.Context, u string) (string, error) {
+	filename, err := dl.s.DownloadLimited(ctx, u, nil, "", dl.maxSize)
+	if err != nil {
+		return "", err
+	}
+
+	pu, err := url.Parse(u)
+	if err == nil {
+		dl.recordName(filename, u, path.Base(pu.Path))
+	}
+
+	return filename, nil
+}
+
+// parseCatboxAlbum extracts the direct file links from a catbox album page.
+func parseCatboxAlbum(doc *html.Node) []string {
+	var links []string
+	seen := map[string]struct{}{}
+
+	web.ForEachLink(doc, func(n *html.Node) error {
+		for _, a := range n.Attr {
+			if a.Key != "href" || !catboxFileRegexp.MatchString(a.Val) {
+				continue
+			}
+			if _, ok := seen[a.Val]; !ok {
+				seen[a.Val] = struct{}{}
+				links = append(links, a.Val)
+			}
+		}
+		return nil
+	})
+
+	return links
+}
+
+// downloadCatboxAlbum downloads a catbox album from the given url. It
+// downloads each constituent file, then builds an html gallery. It returns the
+// path of the gallery.
+func (dl *Downloader) downloadCatboxAlbum(ctx context.Context, u string) (string, error) {
+	desc, err := dl.s.EvaluateURL(u)
+	if err != nil {
+		return "", err
+	}
+
+	if desc.IsLocal {
+		// Already downloaded.
+		return desc.Filename, nil
+	}
+
+	body, err := download.GetBody(ctx, dl.s.HTTPClient(), u, nil)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	doc, err := html.Parse(download.NewContextReader(ctx, body))
+	if err != nil {
+		return "", err
+	}
+
+	links := parseCatboxAlbum(doc)
+	if len(links) == 0 {
+		return "", fmt.Errorf("catbox album contains 0 file links")
+	}
+
+	var filenames []string
+	for _, link := range links {
+		filename, err := dl.downloadCatboxFile(ctx, link)
+		if err != nil {
+			return "", fmt.Errorf("failed to save file belonging to catbox album: file_url=%s err=%w", link, err)
+		}
+		filenames = append(filenames, filename)
+	}
+
+	gallery := web.BuildGallery(u, filenames)
+
+	err = dl.s.SaveFile(desc.Filename, []byte(gallery))
+	if err != nil {
+		return "", err
+	}
+
+	return desc.Filename, nil
+}
+
+// pixeldrainShareURL returns the canonical share page url of the pixeldrain
+// file with the given id. Files are named after this url no matter how they
+// are linked.
+func pixeldrainShareURL(id string) string {
+	return "https://pixeldrain.com/u/" + id
+}
+
+// saveAs downloads a pixeldrain file. The local filename is derived from the
+// file's share page url plus the extension of its original upload name, so
+// that galleries and browsers can tell images from videos.
+func (dl *Downloader) saveAs(ctx context.Context, info pixeldrainFileInfo) (string, error) {
+	shareURL := pixeldrainShareURL(info.ID)
+
+	desc, err := dl.s.EvaluateURL(shareURL)
+	if err != nil {
+		return "", err
+	}
+
+	if desc.IsLocal {
+		// Already downloaded.
+		return desc.Filename, nil
+	}
+
+	filename := desc.Filename + strings.ToLower(path.Ext(info.Name))
+
+	filename, err = dl.s.DownloadLimited(ctx, "https://pixeldrain.com/api/file/"+info.ID, nil, filename, dl.maxSize)
+	if err != nil {
+		return "", err
+	}
+
+	dl.recordName(filename, shareURL, info.Name)
+
+	return filename, nil
+}
+
+// downloadPixeldrainFile downloads the pixeldrain file with the given id.
+func (dl *Downloader) downloadPixeldrainFile(ctx context.Context, id string) (string, error) {
+	if filename, ok := dl.s.Lookup(pixeldrainShareURL(id)); ok {
+		// Already downloaded.
+		return filename, nil
+	}
+
+	b, err := download.Get(ctx, dl.s.HTTPClient(), "https://pixeldrain.com/api/file/"+id+"/info", nil)
+	if err != nil {
+		return "", err
+	}
+
+	info := pixeldrainFileInfo{}
+	err = json.Unmarshal(b, &info)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode pixeldrain file info: %w", err)
+	}
+	info.ID = id
+
+	return dl.saveAs(ctx, info)
+}
+
+// downloadPixeldrainList downloads a pixeldrain list from the given url. It
+// downloads each constituent file, then builds an html gallery. It returns the
+// path of the gallery.
+func (dl *Downloader) downloadPixeldrainList(ctx context.Context, u string, id string) (string, error) {
+	desc, err := dl.s.EvaluateURL(u)
+	if err != nil {
+		return "", err
+	}
+
+	if desc.IsLocal {
+		// Already downloaded.
+		return desc.Filename, nil
+	}
+
+	log.Debugf("scanning pixeldrain list: %s", u)
+
+	b, err := download.Get(ctx, dl.s.HTTPClient(), "https://pixeldrain.com/api/list/"+id, nil)
+	if err != nil {
+		return "", err
+	}
+
+	list := pixeldrainList{}
+	err = json.Unmarshal(b, &list)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode pixeldrain list: %w", err)
+	}
+	if !list.Success {
+		return "", fmt.Errorf("pixeldrain list response has success=false")
+	}
+	if len(list.Files) == 0 {
+		return "", fmt.Errorf("pixeldrain list contains 0 files")
+	}
+
+	var filenames []string
+	for _, info := range list.Files {
+		filename, err := dl.saveAs(ctx, info)
+		if err != nil {
+			return "", fmt.Errorf("failed to save file belonging to pixeldrain list: file_id=%s err=%w", info.ID, err)
+		}
+		filenames = append(filenames, filename)
+	}
+
+	gallery := web.BuildGallery(u, filenames)
+
+	err = dl.s.SaveFile(desc.Filename, []byte(gallery))
+	if err != nil {
+		return "", err
+	}
+
+	return desc.Filename, nil
+}
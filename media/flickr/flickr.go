@@ -0,0 +1,217 @@
+package flickr
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ccollins476ad/bdfrscrape/download"
+	"github.com/ccollins476ad/bdfrscrape/web"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/html"
+)
+
+var (
+	// pageRegexp matches the url of a flickr photo page and captures the
+	// owner's path alias and the photo id.
+	pageRegexp = regexp.MustCompile(`^https://(?:www\.)?flickr\.com/photos/([^/?#]+)/([0-9]+)`)
+
+	// sizeRegexp matches one size entry in the page's embedded photo metadata
+	// and captures the size key and its url.
+	sizeRegexp = regexp.MustCompile(`"([a-z0-9]+)":\{"displayUrl":"([^"]+)"`)
+
+	// realnameRegexp matches the owner's display name in the page's embedded
+	// metadata.
+	realnameRegexp = regexp.MustCompile(`"realname":"([^"]+)"`)
+
+	// licenseRegexp matches the photo's license id in the page's embedded
+	// metadata.
+	licenseRegexp = regexp.MustCompile(`"license":"?([0-9]+)`)
+)
+
+// sizePriority lists flickr size keys from largest to smallest. "o" is the
+// original upload.
+var sizePriority = []string{"o", "6k", "5k", "4k", "3k", "k", "h", "l", "c", "z"}
+
+// licenses maps flickr license ids to names and urls.
+var licenses = map[int][2]string{
+	0:  {"All Rights Reserved", ""},
+	1:  {"CC BY-NC-SA 2.0", "https://creativecommons.org/licenses/by-nc-sa/2.0/"},
+	2:  {"CC BY-NC 2.0", "https://creativecommons.org/licenses/by-nc/2.0/"},
+	3:  {"CC BY-NC-ND 2.0", "https://creativecommons.org/licenses/by-nc-nd/2.0/"},
+	4:  {"CC BY 2.0", "https://creativecommons.org/licenses/by/2.0/"},
+	5:  {"CC BY-SA 2.0", "https://creativecommons.org/licenses/by-sa/2.0/"},
+	6:  {"CC BY-ND 2.0", "https://creativecommons.org/licenses/by-nd/2.0/"},
+	7:  {"No known copyright restrictions", "https://www.flickr.com/commons/usage/"},
+	8:  {"United States Government Work", "http://www.usa.gov/copyright.shtml"},
+	9:  {"CC0 1.0", "https://creativecommons.org/publicdomain/zero/1.0/"},
+	10: {"Public Domain Mark 1.0", "https://creativecommons.org/publicdomain/mark/1.0/"},
+}
+
+// Downloader retrieves photos from flickr photo pages. It saves an
+// attribution sidecar next to each photo. It implements the media.Downloader
+// interface.
+type Downloader struct {
+	s *download.Store
+}
+
+func NewDownloader(s *download.Store) *Downloader {
+	return &Downloader{
+		s: s,
+	}
+}
+
+// Download retrieves the largest available version of the photo on the
+// flickr photo page at the given url. See media.Downloader#Download for API
+// details.
+func (dl *Downloader) Download(ctx context.Context, u string) (string, error) {
+	matches := pageRegexp.FindStringSubmatch(u)
+	if matches == nil {
+		return "", nil
+	}
+
+	return dl.downloadPage(ctx, dl.CanonicalURL(u), matches[1])
+}
+
+// CanonicalURL returns the canonical form of the flickr photo page url=u,
+// which Download saves the photo under. See media.Canonicalizer#CanonicalURL.
+func (dl *Downloader) CanonicalURL(u string) string {
+	matches := pageRegexp.FindStringSubmatch(u)
+	if matches == nil {
+		return u
+	}
+	return "https://www.flickr.com/photos/" + matches[1] + "/" + matches[2] + "/"
+}
+
+// Claims returns true if url=u is a flickr photo page. See
+// media.Downloader#Claims.
+func (dl *Downloader) Claims(u string) bool {
+	return pageRegexp.MatchString(u)
+}
+
+// unescapeJSURL converts a url from the page's embedded metadata into an
+// absolute url.
+func unescapeJSURL(s string) string {
+	s = strings.ReplaceAll(s, `\/`, `/`)
+	if strings.HasPrefix(s, "//") {
+		s = "https:" + s
+	}
+	return s
+}
+
+// photoURL extracts the url of the largest available size of the photo from
+// the raw page. It falls back to the page's og:image.
+func photoURL(raw string, doc *html.Node) (string, error) {
+	sizes := map[string]string{}
+	for _, m := range sizeRegexp.FindAllStringSubmatch(raw, -1) {
+		if _, ok := sizes[m[1]]; !ok {
+			sizes[m[1]] = unescapeJSURL(m[2])
+		}
+	}
+	for _, key := range sizePriority {
+		if su := sizes[key]; su != "" {
+			return su, nil
+		}
+	}
+
+	for _, c := range web.MetaContents(doc, "og:image") {
+		if strings.HasPrefix(c, "https://") {
+			return c, nil
+		}
+	}
+
+	return "", fmt.Errorf("flickr page lacks photo link")
+}
+
+// attribution extracts the photo's title, author, and license from the raw
+// page.
+func attribution(pageURL string, owner string, raw string, doc *html.Node) *download.Attribution {
+	a := &download.Attribution{
+		Source:    pageURL,
+		Author:    owner,
+		AuthorURL: "https://www.flickr.com/photos/" + owner + "/",
+	}
+
+	if titles := web.MetaContents(doc, "og:title"); len(titles) > 0 {
+		a.Title = titles[0]
+	}
+	if m := realnameRegexp.FindStringSubmatch(raw); m != nil {
+		a.Author = m[1]
+	}
+
+	// Prefer the license link the page displays, then the embedded license id.
+	web.ForEachLink(doc, func(n *html.Node) error {
+		var href string
+		var isLicense bool
+		for _, attr := range n.Attr {
+			switch attr.Key {
+			case "href":
+				href = attr.Val
+			case "rel":
+				isLicense = strings.Contains(attr.Val, "license")
+			}
+		}
+		if isLicense && a.LicenseURL == "" {
+			a.LicenseURL = href
+			a.License = web.NodeText(n)
+		}
+		return nil
+	})
+	if a.License == "" {
+		if m := licenseRegexp.FindStringSubmatch(raw); m != nil {
+			id, _ := strconv.Atoi(m[1])
+			if l, ok := licenses[id]; ok {
+				a.License = l[0]
+				a.LicenseURL = l[1]
+			}
+		}
+	}
+
+	return a
+}
+
+// downloadPage downloads the photo on the given flickr photo page, along with
+// an attribution sidecar.
+func (dl *Downloader) downloadPage(ctx context.Context, pageURL string, owner string) (string, error) {
+	desc, err := dl.s.EvaluateURL(pageURL)
+	if err != nil {
+		return "", err
+	}
+
+	if desc.IsLocal {
+		// Already downloaded.
+		return desc.Filename, nil
+	}
+
+	b, err := download.Get(ctx, dl.s.HTTPClient(), pageURL, nil)
+	if err != nil {
+		return "", err
+	}
+	raw := string(b)
+
+	doc, err := html.Parse(strings.NewReader(raw))
+	if err != nil {
+		return "", err
+	}
+
+	targetURL, err := photoURL(raw, doc)
+	if err != nil {
+		return "", err
+	}
+
+	log.Debugf("resolved flickr photo page: %s --> %s", pageURL, targetURL)
+
+	filename, err := dl.s.DownloadAs(ctx, targetURL, nil, desc.Filename)
+	if err != nil {
+		return "", err
+	}
+
+	err = dl.s.SaveAttribution(filename, attribution(pageURL, owner, raw, doc))
+	if err != nil {
+		return "", err
+	}
+
+	return filename, nil
+}
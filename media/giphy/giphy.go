@@ -0,0 +1,75 @@
+package giphy
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/ccollins476ad/bdfrscrape/download"
+)
+
+var (
+	// mediaRegexp matches a direct giphy media link.
+	mediaRegexp = regexp.MustCompile(`^https://(?:i|media[0-9]?)\.giphy\.com/`)
+
+	// pageRegexp matches a giphy gif page or embed and captures the slug,
+	// which ends with the gif id.
+	pageRegexp = regexp.MustCompile(`^https://giphy\.com/(?:gifs|embed|clips)/([A-Za-z0-9-]+)/?$`)
+)
+
+// Downloader retrieves giphy gifs from the web. It implements the
+// media.Downloader interface.
+type Downloader struct {
+	s *download.Store
+}
+
+func NewDownloader(s *download.Store) *Downloader {
+	return &Downloader{
+		s: s,
+	}
+}
+
+// Download retrieves giphy media from the given url. It can download gif
+// pages and direct media links. See media.Downloader#Download for API
+// details.
+func (dl *Downloader) Download(ctx context.Context, u string) (string, error) {
+	if mediaRegexp.MatchString(u) {
+		return dl.s.Download(ctx, u, nil)
+	}
+	if matches := pageRegexp.FindStringSubmatch(u); matches != nil {
+		return dl.downloadPage(ctx, u, matches[1])
+	}
+	return "", nil
+}
+
+// Claims returns true if url=u is a giphy page or media link. See
+// media.Downloader#Claims.
+func (dl *Downloader) Claims(u string) bool {
+	return mediaRegexp.MatchString(u) || pageRegexp.MatchString(u)
+}
+
+// gifID extracts the gif id from a giphy page slug. Slugs have the form
+// "<title-words>-<id>" or just "<id>".
+func gifID(slug string) string {
+	i := strings.LastIndex(slug, "-")
+	return slug[i+1:]
+}
+
+// downloadPage downloads the mp4 rendition of the gif displayed by the given
+// giphy page. The asset url follows from the gif id, so the page itself is
+// not fetched.
+func (dl *Downloader) downloadPage(ctx context.Context, u string, slug string) (string, error) {
+	desc, err := dl.s.EvaluateURL(u)
+	if err != nil {
+		return "", err
+	}
+
+	if desc.IsLocal {
+		// Already downloaded.
+		return desc.Filename, nil
+	}
+
+	targetURL := "https://i.giphy.com/media/" + gifID(slug) + "/giphy.mp4"
+
+	return dl.s.DownloadAs(ctx, targetURL, nil, desc.Filename)
+}
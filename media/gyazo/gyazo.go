@@ -0,0 +1,101 @@
+package gyazo
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/ccollins476ad/bdfrscrape/download"
+	"github.com/ccollins476ad/bdfrscrape/web"
+	"golang.org/x/net/html"
+)
+
+const directPrefix = "https://i.gyazo.com/"
+
+// pageRegexp matches the url of a gyazo screenshot page.
+var pageRegexp = regexp.MustCompile(`^https://gyazo\.com/[0-9a-f]+/?$`)
+
+// Downloader retrieves gyazo screenshots from the web. It implements the
+// media.Downloader interface.
+type Downloader struct {
+	s *download.Store
+}
+
+func NewDownloader(s *download.Store) *Downloader {
+	return &Downloader{
+		s: s,
+	}
+}
+
+// Download retrieves gyazo media from the given url. It can download
+// screenshot pages and direct image links. See media.Downloader#Download for
+// API details.
+func (dl *Downloader) Download(ctx context.Context, u string) (string, error) {
+	if strings.HasPrefix(u, directPrefix) {
+		return dl.s.Download(ctx, u, nil)
+	}
+	if pageRegexp.MatchString(u) {
+		return dl.downloadPage(ctx, dl.CanonicalURL(u))
+	}
+	return "", nil
+}
+
+// CanonicalURL returns the url that Download saves the screenshot on the page
+// at url=u under: the page url without a trailing slash. See
+// media.Canonicalizer#CanonicalURL.
+func (dl *Downloader) CanonicalURL(u string) string {
+	if pageRegexp.MatchString(u) {
+		return strings.TrimSuffix(u, "/")
+	}
+	return u
+}
+
+// Claims returns true if url=u is a gyazo page or direct image link. See
+// media.Downloader#Claims.
+func (dl *Downloader) Claims(u string) bool {
+	return strings.HasPrefix(u, directPrefix) || pageRegexp.MatchString(u)
+}
+
+// parsePage extracts the url of the screenshot from a gyazo page. It prefers
+// the embedded image, then the image declared by the page's meta tags.
+func parsePage(doc *html.Node) (string, error) {
+	candidates := append(web.EmbeddedImageURLs(doc), web.MetaContents(doc, "og:image")...)
+	for _, c := range candidates {
+		if strings.HasPrefix(c, directPrefix) {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("gyazo page lacks image link")
+}
+
+// downloadPage downloads the screenshot displayed by the given gyazo page.
+func (dl *Downloader) downloadPage(ctx context.Context, u string) (string, error) {
+	desc, err := dl.s.EvaluateURL(u)
+	if err != nil {
+		return "", err
+	}
+
+	if desc.IsLocal {
+		// Already downloaded.
+		return desc.Filename, nil
+	}
+
+	body, err := download.GetBody(ctx, dl.s.HTTPClient(), u, nil)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	doc, err := html.Parse(download.NewContextReader(ctx, body))
+	if err != nil {
+		return "", err
+	}
+
+	targetURL, err := parsePage(doc)
+	if err != nil {
+		return "", err
+	}
+
+	return dl.s.DownloadAs(ctx, targetURL, nil, desc.Filename)
+}
@@ -0,0 +1,45 @@
+package media
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/ccollins476ad/bdfrscrape/download"
+)
+
+// HostFilter restricts the hosts that a generic downloader may fetch from. A
+// host matches an entry if it is identical to the entry or is a subdomain of
+// it.
+type HostFilter struct {
+	Allow []string // If non-empty, only matching hosts are permitted.
+	Deny  []string // Matching hosts are never permitted.
+}
+
+// Permits returns true if the filter allows fetching from the host of url=u.
+// It returns false if u is not an absolute http(s) url.
+func (hf *HostFilter) Permits(u string) bool {
+	pu, err := url.Parse(u)
+	if err != nil || (pu.Scheme != "http" && pu.Scheme != "https") {
+		return false
+	}
+	host := strings.ToLower(pu.Hostname())
+	if host == "" {
+		return false
+	}
+
+	for _, d := range hf.Deny {
+		if download.HostMatches(host, d) {
+			return false
+		}
+	}
+
+	if len(hf.Allow) == 0 {
+		return true
+	}
+	for _, a := range hf.Allow {
+		if download.HostMatches(host, a) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,29 +2,58 @@ package imgbb
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/ccollins476ad/bdfrscrape/download"
 	"github.com/ccollins476ad/bdfrscrape/web"
+	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/html"
 )
 
+// maxAlbumPages is the maximum number of album pages the downloader follows.
+// It guards against pagination loops.
+const maxAlbumPages = 100
+
+// imagePageRegexp matches the url of a single-image page.
+var imagePageRegexp = regexp.MustCompile(`^https://ibb\.co/[A-Za-z0-9]+/?$`)
+
 // Downloader retrieves imgbb images from the web. It implements the
 // media.Downloader interface.
 type Downloader struct {
-	s *download.Store
+	s            *download.Store
+	albumTimeout time.Duration
 }
 
-func NewDownloader(s *download.Store) *Downloader {
+// NewDownloader returns a downloader that saves media to s. The albumTimeout
+// parameter is the time limit for saving one album.
+func NewDownloader(s *download.Store, albumTimeout time.Duration) *Downloader {
 	return &Downloader{
-		s: s,
+		s:            s,
+		albumTimeout: albumTimeout,
+	}
+}
+
+// Timeout implements media.Timed#Timeout. An album takes a request per page
+// and per image, far more than the default limit allows for; other links use
+// the default.
+func (dl *Downloader) Timeout(u string) time.Duration {
+	if strings.HasPrefix(u, "https://ibb.co/album/") {
+		return dl.albumTimeout
 	}
+	return 0
 }
 
-// Download retrieves imgbb media from the given url. It can download albums
-// and individual images. See media.Downloader#Download for API details.
+// Download retrieves imgbb media from the given url. It can download albums,
+// image pages, and direct image links. See media.Downloader#Download for API
+// details.
 func (dl *Downloader) Download(ctx context.Context, u string) (string, error) {
+	if strings.HasPrefix(u, "https://i.ibb.co/") {
+		return dl.s.Download(ctx, u, nil)
+	}
 	if strings.HasPrefix(u, "https://ibb.co/album/") {
 		return dl.downloadAlbum(ctx, u)
 	}
@@ -34,34 +63,100 @@ func (dl *Downloader) Download(ctx context.Context, u string) (string, error) {
 	return "", nil
 }
 
-// embeddedImageURLs reads the imgbb album at the specified url and returns the
-// urls of all its images.
-func embeddedImageURLs(doc *html.Node) []string {
-	var urls []string
+// Claims returns true if url=u is an imgbb page, album, or direct image link.
+// See media.Downloader#Claims.
+func (dl *Downloader) Claims(u string) bool {
+	return strings.HasPrefix(u, "https://i.ibb.co/") || strings.HasPrefix(u, "https://ibb.co/")
+}
 
-	rawURLs := web.EmbeddedImageURLs(doc)
-	for _, ru := range rawURLs {
-		if strings.HasPrefix(ru, "https://") {
-			urls = append(urls, ru)
-		}
+// fetchPage retrieves and parses the imgbb html page at the given url.
+func (dl *Downloader) fetchPage(ctx context.Context, u string) (*html.Node, error) {
+	body, err := download.GetBody(ctx, dl.s.HTTPClient(), u, nil)
+	if err != nil {
+		return nil, err
 	}
+	defer body.Close()
 
-	return urls
+	return html.Parse(download.NewContextReader(ctx, body))
 }
 
-// parseAlbum extracts the urls of all images from a imgbb album.
-func parseAlbum(doc *html.Node) ([]string, error) {
-	urls := embeddedImageURLs(doc)
-	if len(urls) == 0 {
-		return nil, fmt.Errorf("imgbb album contains 0 embedded image urls")
+// parseAlbum extracts the urls of the image pages listed on one page of an
+// imgbb album. It also returns the url of the album's next page, or "" if
+// this is the last page.
+func parseAlbum(doc *html.Node) ([]string, string) {
+	var pageURLs []string
+	var next string
+	seen := map[string]struct{}{}
+
+	web.ForEachNode(doc, func(n *html.Node) error {
+		if n.Type != html.ElementNode || (n.Data != "a" && n.Data != "link") {
+			return nil
+		}
+
+		var href string
+		var isNext bool
+		for _, a := range n.Attr {
+			switch {
+			case a.Key == "href":
+				href = a.Val
+			case a.Key == "data-pagination" && a.Val == "next":
+				isNext = true
+			case a.Key == "rel" && a.Val == "next":
+				isNext = true
+			}
+		}
+
+		if isNext {
+			if next == "" && strings.HasPrefix(href, "https://") {
+				next = href
+			}
+			return nil
+		}
+
+		if n.Data == "a" && imagePageRegexp.MatchString(href) {
+			href = strings.TrimSuffix(href, "/")
+			if _, ok := seen[href]; !ok {
+				seen[href] = struct{}{}
+				pageURLs = append(pageURLs, href)
+			}
+		}
+
+		return nil
+	})
+
+	return pageURLs, next
+}
+
+// parseImage extracts the url of the full-size image from an imgbb image page.
+// It prefers the image declared by the page's meta tags, then falls back to
+// the single embedded image.
+func parseImage(doc *html.Node) (string, error) {
+	for _, c := range web.MetaContents(doc, "og:image") {
+		if strings.HasPrefix(c, "https://i.ibb.co/") {
+			return c, nil
+		}
+	}
+
+	imgURLs := web.EmbeddedImageURLs(doc)
+	var targetURL string
+	for _, iu := range imgURLs {
+		if strings.HasPrefix(iu, "https://") {
+			if targetURL != "" {
+				return "", fmt.Errorf("imgbb page contains multiple image links: first=%s second=%s", targetURL, iu)
+			}
+			targetURL = iu
+		}
+	}
+	if targetURL == "" {
+		return "", fmt.Errorf("imgbb page lacks image link")
 	}
 
-	return urls, nil
+	return targetURL, nil
 }
 
-// downloadImage downloads an imgbb album from the given url. It downloads each
-// constituent image, then builds an html gallery. It returns the path of the
-// gallery.
+// downloadAlbum downloads an imgbb album from the given url. It follows the
+// album's pagination, downloads the full-size version of each constituent
+// image, then builds an html gallery. It returns the path of the gallery.
 func (dl *Downloader) downloadAlbum(ctx context.Context, u string) (string, error) {
 	desc, err := dl.s.EvaluateURL(u)
 	if err != nil {
@@ -73,32 +168,51 @@ func (dl *Downloader) downloadAlbum(ctx context.Context, u string) (string, erro
 		return desc.Filename, nil
 	}
 
-	body, err := download.GetBody(ctx, dl.s.HTTPClient(), u, nil)
-	if err != nil {
-		return "", err
-	}
-	defer body.Close()
+	var links []string
+	visited := map[string]struct{}{}
+	for pageURL := u; pageURL != ""; {
+		if len(visited) >= maxAlbumPages {
+			return "", fmt.Errorf("imgbb album exceeds page limit: limit=%d", maxAlbumPages)
+		}
+		visited[pageURL] = struct{}{}
 
-	doc, err := html.Parse(download.NewContextReader(ctx, body))
-	if err != nil {
-		return "", err
+		doc, err := dl.fetchPage(ctx, pageURL)
+		if err != nil {
+			return "", err
+		}
+
+		pageLinks, next := parseAlbum(doc)
+		links = append(links, pageLinks...)
+
+		if _, ok := visited[next]; ok {
+			next = ""
+		}
+		pageURL = next
 	}
 
-	links, err := parseAlbum(doc)
-	if err != nil {
-		return "", err
+	if len(links) == 0 {
+		return "", fmt.Errorf("imgbb album contains 0 image links")
 	}
 
 	var filenames []string
 	for _, link := range links {
-		filename, err := dl.s.Download(ctx, link, nil)
+		filename, err := dl.downloadImage(ctx, link)
+		if errors.Is(err, download.AlreadyAttempted) {
+			// Another link is saving the image, or failed to; either way,
+			// it isn't this album's failure.
+			log.Infof("skipping image already attempted by another link: album_url=%s image_url=%s", u, link)
+			continue
+		}
 		if err != nil {
 			return "", fmt.Errorf("failed to save image belonging to imgbb album: image_url=%s err=%w", link, err)
 		}
 		filenames = append(filenames, filename)
 	}
+	if len(filenames) == 0 {
+		return "", fmt.Errorf("imgbb album contains no image that could be saved: url=%s", u)
+	}
 
-	gallery := web.BuildGallery(filenames)
+	gallery := web.BuildGallery(u, filenames)
 
 	err = dl.s.SaveFile(desc.Filename, []byte(gallery))
 	if err != nil {
@@ -108,7 +222,8 @@ func (dl *Downloader) downloadAlbum(ctx context.Context, u string) (string, erro
 	return desc.Filename, nil
 }
 
-// downloadImage downloads an individual imgbb image from the given url.
+// downloadImage downloads the full-size image displayed by the given imgbb
+// image page.
 func (dl *Downloader) downloadImage(ctx context.Context, u string) (string, error) {
 	desc, err := dl.s.EvaluateURL(u)
 	if err != nil {
@@ -120,30 +235,15 @@ func (dl *Downloader) downloadImage(ctx context.Context, u string) (string, erro
 		return desc.Filename, nil
 	}
 
-	body, err := download.GetBody(ctx, dl.s.HTTPClient(), u, nil)
+	doc, err := dl.fetchPage(ctx, u)
 	if err != nil {
 		return "", err
 	}
-	defer body.Close()
 
-	doc, err := html.Parse(download.NewContextReader(ctx, body))
+	targetURL, err := parseImage(doc)
 	if err != nil {
 		return "", err
 	}
 
-	imgURLs := web.EmbeddedImageURLs(doc)
-	var targetURL string
-	for _, iu := range imgURLs {
-		if strings.HasPrefix(iu, "https://") {
-			if targetURL != "" {
-				return "", fmt.Errorf("imgbb page contains multiple image links: first=%s second=%s", targetURL, iu)
-			}
-			targetURL = iu
-		}
-	}
-	if targetURL == "" {
-		return "", fmt.Errorf("imgbb page lacks image link")
-	}
-
 	return dl.s.DownloadAs(ctx, targetURL, nil, desc.Filename)
 }
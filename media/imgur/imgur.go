@@ -58,14 +58,32 @@ func (dl *Downloader) Download(ctx context.Context, u string) (string, error) {
 
 	// Alternate image url format:
 	//     https://imgur.com/<image_id>
-	imageID := strings.TrimPrefix(u, "https://imgur.com/")
-	if len(imageID) == 7 {
-		return dl.downloadImage(ctx, "https://i.imgur.com/"+imageID+".jpeg")
+	if imageURL := dl.CanonicalURL(u); imageURL != u {
+		return dl.downloadImage(ctx, imageURL)
 	}
 
 	return "", nil
 }
 
+// CanonicalURL returns the direct image url that Download saves an
+// https://imgur.com/<image_id> link under. See
+// media.Canonicalizer#CanonicalURL.
+func (dl *Downloader) CanonicalURL(u string) string {
+	imageID := strings.TrimPrefix(u, "https://imgur.com/")
+	if !strings.HasPrefix(u, "https://imgur.com/a/") && len(imageID) == 7 {
+		return "https://i.imgur.com/" + imageID + ".jpeg"
+	}
+	return u
+}
+
+// Claims returns true if url=u is an imgur album or image link. See
+// media.Downloader#Claims.
+func (dl *Downloader) Claims(u string) bool {
+	return strings.HasPrefix(u, "https://imgur.com/a/") ||
+		strings.HasPrefix(u, "https://i.imgur.com/") ||
+		len(strings.TrimPrefix(u, "https://imgur.com/")) == 7
+}
+
 // albumLinks reads the imgur album at the specified url and returns the urls
 // of all its images.
 func albumLinks(ctx context.Context, hc *http.Client, u string) ([]string, error) {
@@ -143,7 +161,7 @@ func (dl *Downloader) downloadAlbum(ctx context.Context, albumURL string) (strin
 		filenames = append(filenames, filename)
 	}
 
-	gallery := web.BuildGallery(filenames)
+	gallery := web.BuildGallery(albumURL, filenames)
 
 	err = dl.s.SaveFile(desc.Filename, []byte(gallery))
 	if err != nil {
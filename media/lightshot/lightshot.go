@@ -0,0 +1,113 @@
+package lightshot
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/ccollins476ad/bdfrscrape/download"
+	"github.com/ccollins476ad/bdfrscrape/web"
+	"golang.org/x/net/html"
+)
+
+// getHeader makes requests look like they come from a browser that is viewing
+// a lightshot page. Lightshot rejects requests without them.
+var getHeader = http.Header{
+	"referer":    []string{"https://prnt.sc/"},
+	"user-agent": []string{"Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0"},
+}
+
+// imageHosts lists the hosts that serve lightshot screenshots. Placeholder
+// images for deleted screenshots are served from other hosts.
+var imageHosts = map[string]struct{}{
+	"image.prntscr.com": {},
+	"i.imgur.com":       {},
+}
+
+// pageRegexp matches the url of a lightshot screenshot page.
+var pageRegexp = regexp.MustCompile(`^https://(?:www\.)?(?:prnt\.sc|prntscr\.com)/[A-Za-z0-9]+/?$`)
+
+// Downloader retrieves lightshot (prnt.sc) screenshots from the web. It
+// implements the media.Downloader interface.
+type Downloader struct {
+	s *download.Store
+}
+
+func NewDownloader(s *download.Store) *Downloader {
+	return &Downloader{
+		s: s,
+	}
+}
+
+// Download retrieves the lightshot screenshot displayed by the page at the
+// given url. See media.Downloader#Download for API details.
+func (dl *Downloader) Download(ctx context.Context, u string) (string, error) {
+	if pageRegexp.MatchString(u) {
+		return dl.downloadPage(ctx, dl.CanonicalURL(u))
+	}
+	return "", nil
+}
+
+// CanonicalURL returns the url that Download saves the screenshot on the page
+// at url=u under: the page url without a trailing slash. See
+// media.Canonicalizer#CanonicalURL.
+func (dl *Downloader) CanonicalURL(u string) string {
+	if pageRegexp.MatchString(u) {
+		return strings.TrimSuffix(u, "/")
+	}
+	return u
+}
+
+// Claims returns true if url=u is a lightshot screenshot page. See
+// media.Downloader#Claims.
+func (dl *Downloader) Claims(u string) bool {
+	return pageRegexp.MatchString(u)
+}
+
+// parsePage extracts the url of the screenshot from a lightshot page.
+func parsePage(doc *html.Node) (string, error) {
+	for _, iu := range web.EmbeddedImageURLs(doc) {
+		pu, err := url.Parse(iu)
+		if err != nil || pu.Scheme != "https" {
+			continue
+		}
+		if _, ok := imageHosts[pu.Host]; ok {
+			return iu, nil
+		}
+	}
+	return "", fmt.Errorf("lightshot page lacks screenshot link (screenshot deleted?)")
+}
+
+// downloadPage downloads the screenshot displayed by the given lightshot page.
+func (dl *Downloader) downloadPage(ctx context.Context, u string) (string, error) {
+	desc, err := dl.s.EvaluateURL(u)
+	if err != nil {
+		return "", err
+	}
+
+	if desc.IsLocal {
+		// Already downloaded.
+		return desc.Filename, nil
+	}
+
+	body, err := download.GetBody(ctx, dl.s.HTTPClient(), u, getHeader)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	doc, err := html.Parse(download.NewContextReader(ctx, body))
+	if err != nil {
+		return "", err
+	}
+
+	targetURL, err := parsePage(doc)
+	if err != nil {
+		return "", err
+	}
+
+	return dl.s.DownloadAs(ctx, targetURL, getHeader, desc.Filename)
+}
@@ -0,0 +1,168 @@
+package opengraph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+
+	"github.com/ccollins476ad/bdfrscrape/download"
+	"github.com/ccollins476ad/bdfrscrape/media"
+	"github.com/ccollins476ad/bdfrscrape/web"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/html"
+)
+
+// maxPageSize is the largest html page, in bytes, that the downloader parses.
+const maxPageSize = 4 << 20
+
+// metaKeys lists the meta tags that declare a page's media, in order of
+// preference.
+var metaKeys = []string{
+	"og:video:secure_url",
+	"og:video",
+	"og:image:secure_url",
+	"og:image",
+	"twitter:image",
+	"twitter:image:src",
+}
+
+// Downloader retrieves the media declared by OpenGraph and Twitter Card meta
+// tags in arbitrary html pages. It is a fallback for pages that no
+// host-specific downloader claims. It only reads pages from the hosts that
+// its filter permits. It implements the media.Downloader interface.
+type Downloader struct {
+	s  *download.Store
+	hf media.HostFilter
+}
+
+func NewDownloader(s *download.Store, hf media.HostFilter) *Downloader {
+	return &Downloader{
+		s:  s,
+		hf: hf,
+	}
+}
+
+// Download reads the html page at the given url and saves the media that its
+// most preferred meta tag references, skipping tags whose url returns another
+// html page (e.g., a video player). It builds a gallery that credits the page
+// and returns the path of the gallery. It returns the empty string if the url
+// is not an html page or the page declares no media. See
+// media.Downloader#Download for API details.
+func (dl *Downloader) Download(ctx context.Context, u string) (string, error) {
+	if !dl.hf.Permits(u) {
+		return "", nil
+	}
+
+	desc, err := dl.s.EvaluateURL(u)
+	if err != nil {
+		return "", err
+	}
+
+	if desc.IsLocal {
+		// Already downloaded.
+		return desc.Filename, nil
+	}
+
+	doc, err := dl.fetchPage(ctx, u)
+	if err != nil {
+		log.Debugf("ignoring unreadable page: url=%s err=%v", u, err)
+		return "", nil
+	}
+	if doc == nil {
+		return "", nil
+	}
+
+	links := parsePage(doc, u)
+	if len(links) == 0 {
+		log.Debugf("page declares no media: url=%s", u)
+		return "", nil
+	}
+
+	var filename string
+	for _, link := range links {
+		filename, err = dl.s.Download(ctx, link, nil)
+		if errors.Is(err, download.ErrNotMedia) {
+			log.Debugf("ignoring meta tag that declares a page: url=%s media_url=%s", u, link)
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to save media declared by page: media_url=%s err=%w", link, err)
+		}
+		break
+	}
+	if filename == "" {
+		log.Debugf("page declares no usable media: url=%s", u)
+		return "", nil
+	}
+
+	gallery := web.BuildGallery(u, []string{filename})
+
+	err = dl.s.SaveFile(desc.Filename, []byte(gallery))
+	if err != nil {
+		return "", err
+	}
+
+	return desc.Filename, nil
+}
+
+// Claims always returns false: whether a page declares media is only known
+// after fetching it. See media.Downloader#Claims.
+func (dl *Downloader) Claims(u string) bool {
+	return false
+}
+
+// fetchPage retrieves and parses the html page at the given url. It returns
+// nil if the url points to something other than an html page.
+func (dl *Downloader) fetchPage(ctx context.Context, u string) (*html.Node, error) {
+	rsp, err := download.GetResponse(ctx, dl.s.HTTPClient(), u, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	if !download.IsHTML(rsp.Header) {
+		return nil, nil
+	}
+
+	r := io.LimitReader(download.NewContextReader(ctx, rsp.Body), maxPageSize)
+	return html.Parse(r)
+}
+
+// parsePage extracts the urls of the media that the given page declares in
+// its meta tags: the first usable url of each key, in order of preference
+// (see metaKeys). It resolves relative urls against the page url and discards
+// duplicates.
+func parsePage(doc *html.Node, pageURL string) []string {
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return nil
+	}
+
+	seen := map[string]struct{}{}
+
+	var links []string
+	for _, key := range metaKeys {
+		for _, c := range web.MetaContents(doc, key) {
+			ref, err := url.Parse(c)
+			if err != nil {
+				continue
+			}
+
+			abs := base.ResolveReference(ref)
+			if abs.Scheme != "http" && abs.Scheme != "https" {
+				continue
+			}
+
+			link := abs.String()
+			if _, ok := seen[link]; !ok {
+				seen[link] = struct{}{}
+				links = append(links, link)
+			}
+			break
+		}
+	}
+
+	return links
+}
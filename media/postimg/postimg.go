@@ -2,6 +2,7 @@ package postimg
 
 import (
 	"context"
+	"fmt"
 	"regexp"
 	"strings"
 
@@ -12,6 +13,15 @@ import (
 
 var linkRegexp = regexp.MustCompile(`background-image:url\('(https://i.postimg.cc/[^']+)'\)`)
 
+// pageRegexp matches the url of a single-image page and captures the image id.
+var pageRegexp = regexp.MustCompile(`^https://postimg\.cc/([A-Za-z0-9]+)/?$`)
+
+// directRegexp matches a direct image link and captures the image id and the
+// filename extension.
+var directRegexp = regexp.MustCompile(`^https://i\.postimg\.cc/([A-Za-z0-9]+)/[^/?#]*?(\.[A-Za-z0-9]+)?(?:[?#].*)?$`)
+
+const directPrefix = "https://i.postimg.cc/"
+
 type ImageLink struct {
 	ShortName string
 	FullName  string
@@ -21,8 +31,8 @@ func (il *ImageLink) IsPopulated() bool {
 	return il.ShortName != "" && il.FullName != ""
 }
 
-// Downloader retrieves postimg albums from the web. It implements the
-// media.Downloader interface.
+// Downloader retrieves postimg albums and images from the web. It implements
+// the media.Downloader interface.
 type Downloader struct {
 	s *download.Store
 }
@@ -33,15 +43,96 @@ func NewDownloader(s *download.Store) *Downloader {
 	}
 }
 
-// Download retrieves postimg albums from the given url. See
-// media.Downloader#Download for API details.
+// Download retrieves postimg media from the given url. It can download albums,
+// single-image pages, and direct image links. See media.Downloader#Download
+// for API details.
 func (dl *Downloader) Download(ctx context.Context, u string) (string, error) {
 	if strings.HasPrefix(u, "https://postimg.cc/gallery/") {
 		return dl.downloadAlbum(ctx, u)
 	}
+	if strings.HasPrefix(u, directPrefix) {
+		return dl.downloadImage(ctx, u)
+	}
+	if matches := pageRegexp.FindStringSubmatch(u); matches != nil {
+		return dl.downloadPage(ctx, "https://postimg.cc/"+matches[1])
+	}
 	return "", nil
 }
 
+// Claims returns true if url=u is a postimg gallery, image page, or direct
+// image link. See media.Downloader#Claims.
+func (dl *Downloader) Claims(u string) bool {
+	return strings.HasPrefix(u, "https://postimg.cc/gallery/") ||
+		strings.HasPrefix(u, directPrefix) ||
+		pageRegexp.MatchString(u)
+}
+
+// CanonicalURL implements media.Canonicalizer#CanonicalURL. A direct image
+// link is saved under its image id and extension; see canonicalURL.
+func (dl *Downloader) CanonicalURL(u string) string {
+	if c, ok := canonicalURL(u); ok {
+		return c
+	}
+	return u
+}
+
+// canonicalURL returns the url that names the image behind the given direct
+// image link: the link without its filename or query, which vary between
+// links to the same image, but with the filename's extension. Direct links,
+// single-image pages, and albums all lead to a direct link, so an image is
+// only saved once no matter how it is linked.
+func canonicalURL(imageURL string) (string, bool) {
+	matches := directRegexp.FindStringSubmatch(imageURL)
+	if matches == nil {
+		return "", false
+	}
+	return directPrefix + matches[1] + strings.ToLower(matches[2]), true
+}
+
+// parseImage extracts the url of the full-size image from a postimg
+// single-image page. It prefers the page's download link, then the displayed
+// image.
+func parseImage(doc *html.Node) (string, error) {
+	var dlLink, imgLink string
+
+	web.ForEachNode(doc, func(n *html.Node) error {
+		if n.Type != html.ElementNode {
+			return nil
+		}
+
+		for _, a := range n.Attr {
+			switch {
+			case n.Data == "a" && a.Key == "href" && strings.HasPrefix(a.Val, directPrefix):
+				if dlLink == "" {
+					// Strip the "?dl=1" query that forces a download.
+					dlLink, _, _ = strings.Cut(a.Val, "?")
+				}
+
+			case n.Data == "img" && a.Key == "src" && strings.HasPrefix(a.Val, directPrefix):
+				if imgLink == "" {
+					imgLink = a.Val
+				}
+
+			case a.Key == "style":
+				matches := linkRegexp.FindStringSubmatch(a.Val)
+				if len(matches) > 0 && imgLink == "" {
+					imgLink = matches[1]
+				}
+			}
+		}
+
+		return nil
+	})
+
+	if dlLink != "" {
+		return dlLink, nil
+	}
+	if imgLink != "" {
+		return imgLink, nil
+	}
+	return "", fmt.Errorf("postimg page lacks image link")
+}
+
 // parseAlbum extracts the urls of all images from a postimg album.
 func parseAlbum(doc *html.Node) ([]ImageLink, error) {
 	var links []ImageLink
@@ -72,13 +163,54 @@ func parseAlbum(doc *html.Node) ([]ImageLink, error) {
 	return links, nil
 }
 
-// downloadImage downloads an individual postimg image from the given url.
-func (dl *Downloader) downloadImage(ctx context.Context, il ImageLink) (string, error) {
-	filename, err := download.URLToFilename(il.ShortName)
+// downloadImage downloads an individual postimg image from the given direct
+// image link, under the name of its canonical url.
+func (dl *Downloader) downloadImage(ctx context.Context, imageURL string) (string, error) {
+	c, ok := canonicalURL(imageURL)
+	if !ok {
+		return "", fmt.Errorf("postimg image link lacks image id: url=%s", imageURL)
+	}
+
+	desc, err := dl.s.EvaluateURL(c)
+	if err != nil {
+		return "", err
+	}
+
+	if desc.IsLocal {
+		// Already downloaded.
+		return desc.Filename, nil
+	}
+
+	return dl.s.DownloadAs(ctx, imageURL, nil, desc.Filename)
+}
+
+// downloadPage downloads the full-size image displayed by the given postimg
+// single-image page.
+func (dl *Downloader) downloadPage(ctx context.Context, pageURL string) (string, error) {
+	// The manifest remembers which image a page link led to, and an older
+	// version saved images under the page url.
+	if filename, ok := dl.s.Lookup(pageURL); ok {
+		// Already downloaded.
+		return filename, nil
+	}
+
+	body, err := download.GetBody(ctx, dl.s.HTTPClient(), pageURL, nil)
 	if err != nil {
 		return "", err
 	}
-	return dl.s.DownloadAs(ctx, il.FullName, nil, filename)
+	defer body.Close()
+
+	doc, err := html.Parse(download.NewContextReader(ctx, body))
+	if err != nil {
+		return "", err
+	}
+
+	fullName, err := parseImage(doc)
+	if err != nil {
+		return "", err
+	}
+
+	return dl.downloadImage(ctx, fullName)
 }
 
 // downloadImage downloads a postimg album from the given url. It downloads
@@ -113,14 +245,14 @@ func (dl *Downloader) downloadAlbum(ctx context.Context, albumURL string) (strin
 
 	var filenames []string
 	for _, l := range links {
-		filename, err := dl.downloadImage(ctx, l)
+		filename, err := dl.downloadImage(ctx, l.FullName)
 		if err != nil {
 			return "", err
 		}
 		filenames = append(filenames, filename)
 	}
 
-	gallery := web.BuildGallery(filenames)
+	gallery := web.BuildGallery(albumURL, filenames)
 
 	err = dl.s.SaveFile(desc.Filename, []byte(gallery))
 	if err != nil {
@@ -0,0 +1,308 @@
+package sharelink
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ccollins476ad/bdfrscrape/download"
+	"github.com/ccollins476ad/bdfrscrape/web"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/html"
+)
+
+var (
+	// driveFileRegexp matches a google drive file page and captures the file
+	// id.
+	driveFileRegexp = regexp.MustCompile(`^https://drive\.google\.com/file/d/([A-Za-z0-9_-]+)`)
+
+	// extRegexp matches a filename extension that is safe to append to a
+	// local filename.
+	extRegexp = regexp.MustCompile(`^\.[a-z0-9]{1,8}$`)
+)
+
+// Downloader retrieves files shared through Dropbox and Google Drive share
+// links. It implements the media.Downloader interface.
+type Downloader struct {
+	s       *download.Store
+	maxSize int64         // Maximum size of a shared file, in bytes.
+	timeout time.Duration // Time limit for saving one shared file.
+}
+
+func NewDownloader(s *download.Store, maxSize int64, timeout time.Duration) *Downloader {
+	return &Downloader{
+		s:       s,
+		maxSize: maxSize,
+		timeout: timeout,
+	}
+}
+
+// Timeout implements media.Timed#Timeout. Shared files are often videos and
+// archives much larger than typical media.
+func (dl *Downloader) Timeout(u string) time.Duration {
+	return dl.timeout
+}
+
+// dropboxDirectURL converts a dropbox file share link into a direct download
+// link. It returns false if u is not a dropbox file share link.
+func dropboxDirectURL(pu *url.URL) (string, bool) {
+	if pu.Host != "www.dropbox.com" && pu.Host != "dropbox.com" {
+		return "", false
+	}
+	if !strings.HasPrefix(pu.Path, "/s/") && !strings.HasPrefix(pu.Path, "/scl/fi/") {
+		return "", false
+	}
+
+	direct := *pu
+	q := direct.Query()
+	q.Set("dl", "1")
+	direct.RawQuery = q.Encode()
+
+	return direct.String(), true
+}
+
+// driveDirectURL converts a google drive file share link into a direct
+// download link. It returns false if u is not a google drive file share link.
+func driveDirectURL(pu *url.URL) (string, bool) {
+	if pu.Host != "drive.google.com" {
+		return "", false
+	}
+
+	var id string
+	if matches := driveFileRegexp.FindStringSubmatch(pu.String()); matches != nil {
+		id = matches[1]
+	} else if pu.Path == "/open" || pu.Path == "/uc" {
+		id = pu.Query().Get("id")
+	}
+	if id == "" {
+		return "", false
+	}
+
+	return "https://drive.google.com/uc?export=download&id=" + url.QueryEscape(id), true
+}
+
+// directURL converts a share link into a direct download link. It returns
+// false if u is not a supported share link.
+func directURL(u string) (string, bool) {
+	pu, err := url.Parse(u)
+	if err != nil || pu.Scheme != "https" {
+		return "", false
+	}
+
+	if direct, ok := dropboxDirectURL(pu); ok {
+		return direct, true
+	}
+	return driveDirectURL(pu)
+}
+
+// isHTML returns true if the given response carries an html page.
+func isHTML(rsp *http.Response) bool {
+	mt, _, _ := mime.ParseMediaType(rsp.Header.Get("Content-Type"))
+	return mt == "text/html"
+}
+
+// parseConfirmURL extracts the url that confirms the download from a google
+// drive "can't scan this file for viruses" interstitial page. The page either
+// submits a form with the confirmation token or links to the file with a
+// "confirm" query parameter.
+func parseConfirmURL(doc *html.Node, base *url.URL) (string, error) {
+	for _, form := range web.NodesWithDataVal(doc, "form") {
+		var action string
+		for _, a := range form.Attr {
+			if a.Key == "action" {
+				action = a.Val
+			}
+		}
+		if action == "" {
+			continue
+		}
+
+		q := url.Values{}
+		for _, input := range web.NodesWithDataVal(form, "input") {
+			var name, val, typ string
+			for _, a := range input.Attr {
+				switch a.Key {
+				case "name":
+					name = a.Val
+				case "value":
+					val = a.Val
+				case "type":
+					typ = a.Val
+				}
+			}
+			if typ == "hidden" && name != "" {
+				q.Set(name, val)
+			}
+		}
+		if q.Get("confirm") == "" {
+			continue
+		}
+
+		ref, err := url.Parse(action)
+		if err != nil {
+			continue
+		}
+		abs := base.ResolveReference(ref)
+		abs.RawQuery = q.Encode()
+		return abs.String(), nil
+	}
+
+	var confirmURL string
+	web.ForEachLink(doc, func(n *html.Node) error {
+		for _, a := range n.Attr {
+			if a.Key == "href" && confirmURL == "" && strings.Contains(a.Val, "confirm=") {
+				ref, err := url.Parse(a.Val)
+				if err == nil {
+					confirmURL = base.ResolveReference(ref).String()
+				}
+			}
+		}
+		return nil
+	})
+	if confirmURL != "" {
+		return confirmURL, nil
+	}
+
+	return "", fmt.Errorf("google drive returned a page without a download link (file private or over quota?)")
+}
+
+// responseFilename returns the filename that the given response's
+// Content-Disposition header specifies, or "" if there is none.
+func responseFilename(rsp *http.Response) string {
+	_, params, err := mime.ParseMediaType(rsp.Header.Get("Content-Disposition"))
+	if err != nil || params["filename"] == "" {
+		return ""
+	}
+	return path.Base(params["filename"])
+}
+
+// Download retrieves the file behind a Dropbox or Google Drive share link. It
+// saves the file under a name derived from the share link plus the extension
+// of the file's real name, and records the real name in the manifest. See
+// media.Downloader#Download for API details.
+func (dl *Downloader) Download(ctx context.Context, u string) (string, error) {
+	direct, ok := directURL(u)
+	if !ok {
+		return "", nil
+	}
+
+	desc, err := dl.s.EvaluateURL(u)
+	if err != nil {
+		return "", err
+	}
+
+	if desc.IsLocal {
+		// Already downloaded.
+		return desc.Filename, nil
+	}
+
+	// Google drive's confirmation flow relies on cookies set by the first
+	// response.
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return "", err
+	}
+	hc := *dl.s.HTTPClient()
+	hc.Jar = jar
+
+	rsp, err := download.GetResponse(ctx, &hc, direct, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if isHTML(rsp) {
+		doc, err := html.Parse(download.NewContextReader(ctx, rsp.Body))
+		rsp.Body.Close()
+		if err != nil {
+			return "", err
+		}
+
+		confirmURL, err := parseConfirmURL(doc, rsp.Request.URL)
+		if err != nil {
+			return "", err
+		}
+
+		log.Debugf("following download confirmation: %s --> %s", u, confirmURL)
+
+		rsp, err = download.GetResponse(ctx, &hc, confirmURL, nil)
+		if err != nil {
+			return "", err
+		}
+		if isHTML(rsp) {
+			rsp.Body.Close()
+			return "", fmt.Errorf("share link resolved to an html page instead of a file: url=%s", u)
+		}
+	}
+	defer rsp.Body.Close()
+
+	name := responseFilename(rsp)
+
+	filename := desc.Filename
+	if ext := strings.ToLower(path.Ext(name)); extRegexp.MatchString(ext) && !strings.HasSuffix(filename, ext) {
+		filename += ext
+	}
+
+	err = dl.saveBody(ctx, filename, rsp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	dl.s.Manifest().Update(filename, func(e *download.ManifestEntry) {
+		e.URL = u
+		e.OriginalName = name
+	})
+
+	return filename, nil
+}
+
+// saveBody streams a shared file's body into the destination directory under
+// the given filename. Shared files can be far too large to hold in memory, so
+// it writes them to a scratch file first.
+func (dl *Downloader) saveBody(ctx context.Context, filename string, body io.Reader) error {
+	dir, err := dl.s.TempDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	tmpPath := filepath.Join(dir, filename)
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = download.NewContextReader(ctx, body)
+	if dl.maxSize > 0 {
+		r = io.LimitReader(r, dl.maxSize+1)
+	}
+
+	n, err := io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if dl.maxSize > 0 && n > dl.maxSize {
+		return fmt.Errorf("shared file exceeds size cap: cap=%d", dl.maxSize)
+	}
+
+	return dl.s.ImportFile(filename, tmpPath)
+}
+
+// Claims returns true if url=u is a dropbox or google drive share link. See
+// media.Downloader#Claims.
+func (dl *Downloader) Claims(u string) bool {
+	_, ok := directURL(u)
+	return ok
+}
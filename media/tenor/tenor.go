@@ -0,0 +1,91 @@
+package tenor
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/ccollins476ad/bdfrscrape/download"
+	"github.com/ccollins476ad/bdfrscrape/web"
+	"golang.org/x/net/html"
+)
+
+// pageRegexp matches the url of a tenor gif page. Pages may carry a language
+// prefix (e.g., "/en-GB/view/...").
+var pageRegexp = regexp.MustCompile(`^https://tenor\.com/(?:[a-zA-Z-]+/)?view/[^/?#]+`)
+
+// Downloader retrieves tenor gifs from the web. It implements the
+// media.Downloader interface.
+type Downloader struct {
+	s *download.Store
+}
+
+func NewDownloader(s *download.Store) *Downloader {
+	return &Downloader{
+		s: s,
+	}
+}
+
+// Download retrieves tenor media from the given url. It can download gif
+// pages and direct media links. See media.Downloader#Download for API
+// details.
+func (dl *Downloader) Download(ctx context.Context, u string) (string, error) {
+	if strings.HasPrefix(u, "https://media.tenor.com/") || strings.HasPrefix(u, "https://c.tenor.com/") {
+		return dl.s.Download(ctx, u, nil)
+	}
+	if pageRegexp.MatchString(u) {
+		return dl.downloadPage(ctx, u)
+	}
+	return "", nil
+}
+
+// Claims returns true if url=u is a tenor page or media link. See
+// media.Downloader#Claims.
+func (dl *Downloader) Claims(u string) bool {
+	return strings.HasPrefix(u, "https://media.tenor.com/") ||
+		strings.HasPrefix(u, "https://c.tenor.com/") ||
+		pageRegexp.MatchString(u)
+}
+
+// parsePage extracts the url of a gif page's media from its meta tags. It
+// prefers the mp4 rendition over the gif.
+func parsePage(doc *html.Node) (string, error) {
+	for _, c := range web.MetaContents(doc, "og:video:secure_url", "og:video", "og:image") {
+		if strings.HasPrefix(c, "https://media.tenor.com/") || strings.HasPrefix(c, "https://c.tenor.com/") {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("tenor page lacks media link")
+}
+
+// downloadPage downloads the media displayed by the given tenor gif page.
+func (dl *Downloader) downloadPage(ctx context.Context, u string) (string, error) {
+	desc, err := dl.s.EvaluateURL(u)
+	if err != nil {
+		return "", err
+	}
+
+	if desc.IsLocal {
+		// Already downloaded.
+		return desc.Filename, nil
+	}
+
+	body, err := download.GetBody(ctx, dl.s.HTTPClient(), u, nil)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	doc, err := html.Parse(download.NewContextReader(ctx, body))
+	if err != nil {
+		return "", err
+	}
+
+	targetURL, err := parsePage(doc)
+	if err != nil {
+		return "", err
+	}
+
+	return dl.s.DownloadAs(ctx, targetURL, nil, desc.Filename)
+}
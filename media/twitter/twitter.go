@@ -0,0 +1,96 @@
+package twitter
+
+import (
+	"context"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/ccollins476ad/bdfrscrape/download"
+	log "github.com/sirupsen/logrus"
+)
+
+// Downloader retrieves twitter/X images from pbs.twimg.com. It implements the
+// media.Downloader interface.
+type Downloader struct {
+	s *download.Store
+}
+
+func NewDownloader(s *download.Store) *Downloader {
+	return &Downloader{
+		s: s,
+	}
+}
+
+// normalizeURL converts any variant of a pbs.twimg.com image url into the url
+// of the original-resolution image. For example, all of the below:
+//
+//	https://pbs.twimg.com/media/<id>.jpg
+//	https://pbs.twimg.com/media/<id>.jpg:large
+//	https://pbs.twimg.com/media/<id>?format=jpg&name=small
+//
+// become:
+//
+//	https://pbs.twimg.com/media/<id>?format=jpg&name=orig
+//
+// It returns false if u is not a pbs.twimg.com image url.
+func normalizeURL(u string) (string, bool) {
+	pu, err := url.Parse(u)
+	if err != nil || pu.Host != "pbs.twimg.com" || !strings.HasPrefix(pu.Path, "/media/") {
+		return "", false
+	}
+
+	// Strip the legacy ":size" suffix.
+	name, _, _ := strings.Cut(path.Base(pu.Path), ":")
+
+	format := pu.Query().Get("format")
+	if ext := path.Ext(name); ext != "" {
+		name = strings.TrimSuffix(name, ext)
+		if format == "" {
+			format = strings.TrimPrefix(ext, ".")
+		}
+	}
+	if name == "" || name == "." {
+		return "", false
+	}
+	if format == "" {
+		format = "jpg"
+	}
+
+	q := url.Values{}
+	q.Set("format", format)
+	q.Set("name", "orig")
+
+	return "https://pbs.twimg.com/media/" + name + "?" + q.Encode(), true
+}
+
+// Download retrieves the original-resolution version of the twitter image at
+// the given url. See media.Downloader#Download for API details.
+func (dl *Downloader) Download(ctx context.Context, u string) (string, error) {
+	orig, ok := normalizeURL(u)
+	if !ok {
+		return "", nil
+	}
+
+	if orig != u {
+		log.Debugf("normalized twitter image url: %s --> %s", u, orig)
+	}
+
+	return dl.s.Download(ctx, orig, nil)
+}
+
+// CanonicalURL returns the original-resolution url that Download saves the
+// image at url=u under. See media.Canonicalizer#CanonicalURL.
+func (dl *Downloader) CanonicalURL(u string) string {
+	if orig, ok := normalizeURL(u); ok {
+		return orig
+	}
+	return u
+}
+
+// Claims returns true if url=u is a pbs.twimg.com image link. See
+// media.Downloader#Claims.
+func (dl *Downloader) Claims(u string) bool {
+	_, ok := normalizeURL(u)
+	return ok
+}
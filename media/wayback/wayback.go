@@ -0,0 +1,172 @@
+package wayback
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ccollins476ad/bdfrscrape/download"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultAPIURL is the url of the Wayback Machine availability API.
+const DefaultAPIURL = "https://archive.org/wayback/available"
+
+// timestampFormat is the layout of Wayback Machine timestamps.
+const timestampFormat = "20060102150405"
+
+// maxResponseSize is the largest availability API response, in bytes, that
+// the downloader decodes. A real response is a few hundred bytes.
+const maxResponseSize = 64 << 10
+
+type snapshot struct {
+	Available bool   `json:"available"`
+	URL       string `json:"url"`
+	Timestamp string `json:"timestamp"`
+	Status    string `json:"status"`
+}
+
+type availabilityResponse struct {
+	ArchivedSnapshots struct {
+		Closest *snapshot `json:"closest"`
+	} `json:"archived_snapshots"`
+}
+
+// Downloader recovers dead media links from the Internet Archive's Wayback
+// Machine. It is not a media.Downloader; it is a fallback for links that
+// another downloader failed to retrieve.
+type Downloader struct {
+	s       *download.Store
+	apiURL  string
+	maxSize int64 // Maximum size of a capture, in bytes; 0 for no limit.
+}
+
+// NewDownloader creates a wayback downloader that queries the availability
+// API at apiURL (normally DefaultAPIURL) and saves captures of up to maxSize
+// bytes.
+func NewDownloader(s *download.Store, apiURL string, maxSize int64) *Downloader {
+	return &Downloader{
+		s:       s,
+		apiURL:  apiURL,
+		maxSize: maxSize,
+	}
+}
+
+// closest queries the availability API for the capture of url=u that is
+// closest to time t. It returns nil if the archive has no usable capture.
+func (dl *Downloader) closest(ctx context.Context, u string, t time.Time) (*snapshot, error) {
+	q := url.Values{}
+	q.Set("url", u)
+	if !t.IsZero() {
+		q.Set("timestamp", t.UTC().Format(timestampFormat))
+	}
+
+	b, err := download.GetLimited(ctx, dl.s.HTTPClient(), dl.apiURL+"?"+q.Encode(), nil, maxResponseSize)
+	if err != nil {
+		return nil, err
+	}
+
+	ar := &availabilityResponse{}
+	err = json.Unmarshal(b, ar)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode wayback availability response: %w", err)
+	}
+
+	snap := ar.ArchivedSnapshots.Closest
+	if snap == nil || !snap.Available || snap.URL == "" || snap.Timestamp == "" {
+		return nil, nil
+	}
+	if snap.Status != "" && !strings.HasPrefix(snap.Status, "2") {
+		return nil, nil
+	}
+
+	return snap, nil
+}
+
+// rawURL converts the url of a wayback capture into the url of the raw
+// ("id_") capture, which lacks the archive's banner and link rewriting.
+func rawURL(snap *snapshot) (string, error) {
+	marker := "/" + snap.Timestamp + "/"
+	if !strings.Contains(snap.URL, marker) {
+		return "", fmt.Errorf("wayback snapshot url lacks timestamp: url=%s", snap.URL)
+	}
+	return strings.Replace(snap.URL, marker, "/"+snap.Timestamp+"id_/", 1), nil
+}
+
+// Recover saves the capture of media url=u that is closest to time t (e.g.,
+// the creation time of the post that links to it). The zero time means "any
+// capture". It saves the file with the same name that a direct download of u
+// would have used and records the capture in the manifest. It returns the
+// path of the saved file, relative to the destination directory.
+func (dl *Downloader) Recover(ctx context.Context, u string, t time.Time) (string, error) {
+	if filename, ok := dl.s.Lookup(u); ok {
+		// Already recovered.
+		return filename, nil
+	}
+
+	filename, err := download.URLToFilename(u)
+	if err != nil {
+		return "", err
+	}
+
+	snap, err := dl.closest(ctx, u, t)
+	if err != nil {
+		return "", err
+	}
+	if snap == nil {
+		return "", fmt.Errorf("no wayback capture: url=%s", u)
+	}
+
+	raw, err := rawURL(snap)
+	if err != nil {
+		return "", err
+	}
+
+	log.Debugf("recovering from wayback: %s --> %s", u, raw)
+
+	rsp, err := download.GetResponse(ctx, dl.s.HTTPClient(), raw, nil)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+
+	// A page rather than media means the archive captured an error page or an
+	// html wrapper. Neither is worth keeping.
+	mt, _, _ := mime.ParseMediaType(rsp.Header.Get("Content-Type"))
+	if mt == "text/html" {
+		return "", fmt.Errorf("wayback capture is not media: url=%s", raw)
+	}
+
+	var r io.Reader = download.NewContextReader(ctx, rsp.Body)
+	if dl.maxSize > 0 {
+		r = io.LimitReader(r, dl.maxSize+1)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	if dl.maxSize > 0 && int64(len(b)) > dl.maxSize {
+		return "", fmt.Errorf("wayback capture exceeds size limit: url=%s limit=%d", raw, dl.maxSize)
+	}
+
+	err = dl.s.SaveFile(filename, b)
+	if err != nil {
+		return "", err
+	}
+
+	dl.s.Manifest().Update(filename, func(e *download.ManifestEntry) {
+		e.URL = u
+		e.Archive = &download.ArchiveInfo{
+			Service:     "wayback",
+			SnapshotURL: raw,
+			Timestamp:   snap.Timestamp,
+		}
+	})
+
+	return filename, nil
+}
@@ -0,0 +1,178 @@
+package wayback
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ccollins476ad/bdfrscrape/download"
+)
+
+const (
+	deadURL   = "https://i.imgur.com/abcdefg.jpg"
+	timestamp = "20200102030405"
+)
+
+// newStandIn returns a server that stands in for the Wayback Machine. Its
+// availability API, at /available, offers a capture of each url for which
+// captures holds a content type; /web/<timestamp>id_/<url> serves the
+// capture with that content type. The API records the timestamp it was asked
+// for in *asked.
+func newStandIn(t *testing.T, captures map[string]string, asked *string) *httptest.Server {
+	var srv *httptest.Server
+
+	// Not a ServeMux, which would clean the "//" out of capture paths.
+	available := func(w http.ResponseWriter, r *http.Request) {
+		u := r.URL.Query().Get("url")
+		*asked = r.URL.Query().Get("timestamp")
+
+		ar := availabilityResponse{}
+		if _, ok := captures[u]; ok {
+			ar.ArchivedSnapshots.Closest = &snapshot{
+				Available: true,
+				URL:       srv.URL + "/web/" + timestamp + "/" + u,
+				Timestamp: timestamp,
+				Status:    "200",
+			}
+		}
+		json.NewEncoder(w).Encode(ar)
+	}
+	capture := func(w http.ResponseWriter, r *http.Request) {
+		u, ok := strings.CutPrefix(r.URL.Path, "/web/"+timestamp+"id_/")
+		if !ok {
+			http.Error(w, "not a raw capture", http.StatusNotFound)
+			return
+		}
+		ct, ok := captures[u]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", ct)
+		w.Write([]byte("capture of " + u))
+	}
+
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/available" {
+			available(w, r)
+		} else {
+			capture(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestRecover(t *testing.T) {
+	var asked string
+	srv := newStandIn(t, map[string]string{deadURL: "image/jpeg"}, &asked)
+
+	destDir := t.TempDir()
+	man := download.NewManifest()
+	s := download.NewStore(destDir, man, srv.Client())
+	dl := NewDownloader(s, srv.URL+"/available", 0)
+
+	created := time.Date(2019, 5, 6, 7, 8, 9, 0, time.UTC)
+	filename, err := dl.Recover(context.Background(), deadURL, created)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if asked != "20190506070809" {
+		t.Errorf("asked for timestamp %q, want the post's creation time", asked)
+	}
+
+	want, err := download.URLToFilename(deadURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filename != want {
+		t.Errorf("filename=%s, want %s", filename, want)
+	}
+
+	b, err := os.ReadFile(filepath.Join(destDir, filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "capture of "+deadURL {
+		t.Errorf("saved %q, want the raw capture", b)
+	}
+
+	e, ok := man.Lookup(filename)
+	if !ok {
+		t.Fatal("manifest lacks the recovered file")
+	}
+	if e.URL != deadURL {
+		t.Errorf("manifest url=%s, want %s", e.URL, deadURL)
+	}
+	wantSnap := srv.URL + "/web/" + timestamp + "id_/" + deadURL
+	if e.Archive == nil || e.Archive.Service != "wayback" || e.Archive.SnapshotURL != wantSnap || e.Archive.Timestamp != timestamp {
+		t.Errorf("manifest archive=%+v, want wayback capture %s", e.Archive, wantSnap)
+	}
+
+	// A second recovery finds the file without asking the archive again.
+	srv.Close()
+	again, err := dl.Recover(context.Background(), deadURL, created)
+	if err != nil || again != filename {
+		t.Errorf("second recovery: filename=%s err=%v, want %s", again, err, filename)
+	}
+}
+
+func TestRecoverFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		captures map[string]string
+		maxSize  int64
+	}{
+		{name: "html capture", captures: map[string]string{deadURL: "text/html"}},
+		{name: "no capture", captures: map[string]string{}},
+		{name: "oversized capture", captures: map[string]string{deadURL: "image/jpeg"}, maxSize: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var asked string
+			srv := newStandIn(t, tt.captures, &asked)
+
+			destDir := t.TempDir()
+			s := download.NewStore(destDir, download.NewManifest(), srv.Client())
+			dl := NewDownloader(s, srv.URL+"/available", tt.maxSize)
+
+			filename, err := dl.Recover(context.Background(), deadURL, time.Time{})
+			if err == nil {
+				t.Fatalf("recovered %s, want error", filename)
+			}
+
+			entries, err := os.ReadDir(destDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 0 {
+				t.Errorf("destination directory holds %d entries, want none", len(entries))
+			}
+		})
+	}
+}
+
+func TestRecoverOversizedResponse(t *testing.T) {
+	// An availability API that never stops talking.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"archived_snapshots": {"closest": {"url": "`))
+		w.Write([]byte(strings.Repeat("x", 2*maxResponseSize)))
+	}))
+	t.Cleanup(srv.Close)
+
+	s := download.NewStore(t.TempDir(), download.NewManifest(), srv.Client())
+	dl := NewDownloader(s, srv.URL, 0)
+
+	_, err := dl.Recover(context.Background(), deadURL, time.Time{})
+	if err == nil || !strings.Contains(err.Error(), "size limit") {
+		t.Errorf("err=%v, want size limit error", err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/ccollins476ad/bdfrscrape/bdfr"
+	"github.com/ccollins476ad/bdfrscrape/download"
+	log "github.com/sirupsen/logrus"
+)
+
+// PlanHost summarizes what a run would do with the links to one host.
+type PlanHost struct {
+	Host        string         `json:"host"`
+	Links       int            `json:"links"`                 // Distinct links to the host.
+	Local       int            `json:"local"`                 // Links whose media is already on disk.
+	Unsupported int            `json:"unsupported"`           // Links that aren't local and that no downloader claims.
+	Downloaders map[string]int `json:"downloaders,omitempty"` // Links that aren't local, by claiming downloader.
+}
+
+// Plan describes what a run would do, without doing it. See planFiles.
+type Plan struct {
+	Posts          int        `json:"posts"`           // Posts that the run would process.
+	UnchangedPosts int        `json:"unchanged_posts"` // Posts that the run would skip as unchanged.
+	FailedPosts    int        `json:"failed_posts"`    // Posts that could not be read.
+	Links          int        `json:"links"`           // Distinct links in the processed posts.
+	Local          int        `json:"local"`           // Links whose media is already on disk.
+	Claimed        int        `json:"claimed"`         // Links that aren't local and that some downloader claims.
+	Unsupported    int        `json:"unsupported"`     // Links that aren't local and that no downloader claims.
+	Hosts          []PlanHost `json:"hosts"`           // Sorted by number of links, most first.
+
+	// Hosts with unsupported links, sorted by number of unsupported links,
+	// most first. Generic fallback downloaders still probe these links
+	// during a real run.
+	UnsupportedHosts []PlanHost `json:"unsupported_hosts"`
+}
+
+// planFiles walks the given posts and reports, for each link, whether its
+// media is already local and which downloader would claim it. It makes no
+// network requests and writes nothing to disk.
+func planFiles(cfg *Config, filenames []string) (*Plan, error) {
+	manifest, err := download.LoadManifest(download.ManifestPath(cfg.DestDir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load manifest: %w", err)
+	}
+
+	// Nothing here downloads.
+	s := download.NewStore(cfg.DestDir, manifest, download.NewOfflineClient())
+	dls, err := newDownloaders(cfg, s)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &scraper{
+		cfg: cfg,
+		s:   s,
+		dls: dls,
+		man: manifest,
+	}
+
+	p := &Plan{}
+	hosts := map[string]*PlanHost{}
+	seen := map[string]bool{}
+
+	for _, filename := range filenames {
+		srcPath := cfg.Source + "/" + filename
+
+		if sc.postUnchanged(filename, srcPath) {
+			p.UnchangedPosts++
+			continue
+		}
+
+		m, err := bdfr.ReadMessage(srcPath)
+		if err != nil {
+			log.WithError(err).Errorf("failed to read post: filename=%s", filename)
+			p.FailedPosts++
+			continue
+		}
+
+		err = walkPost(filename, m, func(msg bdfr.Message, src linkSource, mdKey string, htmlKey string) error {
+			links, err := messageLinks(msg, mdKey, htmlKey)
+			if err != nil {
+				return err
+			}
+
+			for _, link := range links {
+				if seen[link] {
+					continue
+				}
+				seen[link] = true
+
+				host := linkHost(link)
+				h := hosts[host]
+				if h == nil {
+					h = &PlanHost{
+						Host:        host,
+						Downloaders: map[string]int{},
+					}
+					hosts[host] = h
+				}
+				h.Links++
+				p.Links++
+
+				// Look the link up as an offline run would, so that media
+				// saved under a canonical url counts as local.
+				local, name := sc.lookupMedia(link)
+				if local != "" {
+					h.Local++
+					p.Local++
+					continue
+				}
+				if name == "" {
+					h.Unsupported++
+					p.Unsupported++
+					continue
+				}
+				h.Downloaders[name]++
+				p.Claimed++
+			}
+
+			return nil
+		})
+		if err != nil {
+			log.WithError(err).Errorf("failed to read post: filename=%s", filename)
+			p.FailedPosts++
+			continue
+		}
+
+		p.Posts++
+	}
+
+	for _, h := range hosts {
+		if len(h.Downloaders) == 0 {
+			h.Downloaders = nil
+		}
+		p.Hosts = append(p.Hosts, *h)
+		if h.Unsupported > 0 {
+			p.UnsupportedHosts = append(p.UnsupportedHosts, *h)
+		}
+	}
+
+	sortHosts := func(hs []PlanHost, count func(h PlanHost) int) {
+		sort.Slice(hs, func(i, j int) bool {
+			if count(hs[i]) != count(hs[j]) {
+				return count(hs[i]) > count(hs[j])
+			}
+			return hs[i].Host < hs[j].Host
+		})
+	}
+	sortHosts(p.Hosts, func(h PlanHost) int { return h.Links })
+	sortHosts(p.UnsupportedHosts, func(h PlanHost) int { return h.Unsupported })
+
+	return p, nil
+}
+
+// postUnchanged returns true if a run would skip the given source post
+// without reading it: it has the same size and modification time as when a
+// previous run processed it, and reusablePost allows keeping its processed
+// copy.
+func (sc *scraper) postUnchanged(filename string, srcPath string) bool {
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return false
+	}
+
+	prev, ok := sc.reusablePost(filename)
+	return ok && statUnchanged(prev, info)
+}
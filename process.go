@@ -2,27 +2,217 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
+	"io/fs"
+	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ccollins476ad/bdfrscrape/bdfr"
 	"github.com/ccollins476ad/bdfrscrape/download"
+	"github.com/ccollins476ad/bdfrscrape/fileutil"
+	"github.com/ccollins476ad/bdfrscrape/markdown"
 	"github.com/ccollins476ad/bdfrscrape/media"
+	"github.com/ccollins476ad/bdfrscrape/media/commons"
+	"github.com/ccollins476ad/bdfrscrape/media/direct"
+	"github.com/ccollins476ad/bdfrscrape/media/extcmd"
+	"github.com/ccollins476ad/bdfrscrape/media/filedrop"
+	"github.com/ccollins476ad/bdfrscrape/media/flickr"
+	"github.com/ccollins476ad/bdfrscrape/media/giphy"
+	"github.com/ccollins476ad/bdfrscrape/media/gyazo"
 	"github.com/ccollins476ad/bdfrscrape/media/imgbb"
 	"github.com/ccollins476ad/bdfrscrape/media/imgur"
+	"github.com/ccollins476ad/bdfrscrape/media/lightshot"
+	"github.com/ccollins476ad/bdfrscrape/media/opengraph"
 	"github.com/ccollins476ad/bdfrscrape/media/postimg"
+	"github.com/ccollins476ad/bdfrscrape/media/sharelink"
+	"github.com/ccollins476ad/bdfrscrape/media/tenor"
+	"github.com/ccollins476ad/bdfrscrape/media/twitter"
+	"github.com/ccollins476ad/bdfrscrape/media/wayback"
+	"github.com/ccollins476ad/bdfrscrape/web"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
-	"mvdan.cc/xurls/v2"
 )
 
+// scraper holds the state shared by the goroutines that process posts.
+type scraper struct {
+	cfg   *Config
+	s     *download.Store     // Saves media, or in an offline run, finds it on disk.
+	dls   []media.Downloader  // Tried in order for each link.
+	wb    *wayback.Downloader // Nil if the wayback fallback is disabled.
+	man   *download.Manifest  // Records saved media and processed posts.
+	rep   *Report             // Outcome of every link found.
+	fails *failures           // Posts and links that failed.
+
+	callsMtx sync.Mutex
+	calls    map[string]*linkCall   // Resolution of each link seen so far, by link. Protected by callsMtx.
+	active   map[*linkCall]struct{} // Resolutions in progress. Protected by callsMtx.
+}
+
+// linkCall is the one resolution of a link that every message holding the
+// link shares.
+type linkCall struct {
+	done    chan struct{} // Closed once res is set.
+	res     *linkResult
+	waiting bool // Whether the resolution is waiting for others to finish. Protected by scraper.callsMtx.
+}
+
+// newDownloaders returns the downloaders that processBody dispatches links to,
+// in priority order. Generic fallbacks come last. If cfg.Downloaders is
+// non-empty, it returns only the downloaders named there. It returns an error
+// if cfg.Downloaders names an unknown downloader.
+func newDownloaders(cfg *Config, s *download.Store) ([]media.Downloader, error) {
+	hf := media.HostFilter{
+		Allow: cfg.AllowHosts,
+		Deny:  cfg.DenyHosts,
+	}
+
+	var dls []media.Downloader
+
+	// User-configured commands take precedence over built-in downloaders.
+	if len(cfg.ExecRules) > 0 {
+		dls = append(dls, extcmd.NewDownloader(s, cfg.ExecRules, cfg.ExecTimeout))
+	}
+
+	dls = append(dls,
+		imgur.NewDownloader(s),
+		postimg.NewDownloader(s),
+		imgbb.NewDownloader(s, cfg.AlbumTimeout),
+		filedrop.NewDownloader(s, cfg.MaxShareSize, cfg.ShareTimeout),
+		gyazo.NewDownloader(s),
+		lightshot.NewDownloader(s),
+		sharelink.NewDownloader(s, cfg.MaxShareSize, cfg.ShareTimeout),
+		twitter.NewDownloader(s),
+		tenor.NewDownloader(s),
+		giphy.NewDownloader(s),
+		commons.NewDownloader(s),
+		flickr.NewDownloader(s),
+		direct.NewDownloader(s, hf, cfg.MaxMediaSize),
+		opengraph.NewDownloader(s, media.HostFilter{
+			Allow: cfg.OpenGraphHosts,
+			Deny:  append(append([]string(nil), cfg.DenyHosts...), cfg.OpenGraphDeny...),
+		}),
+	)
+
+	if len(cfg.Downloaders) == 0 {
+		return dls, nil
+	}
+
+	known := map[string]bool{
+		"extcmd": true,
+	}
+	for _, dl := range dls {
+		known[downloaderName(dl)] = true
+	}
+
+	enabled := map[string]bool{}
+	for _, name := range cfg.Downloaders {
+		if !known[name] {
+			return nil, fmt.Errorf("unknown downloader: %s", name)
+		}
+		enabled[name] = true
+	}
+
+	var filtered []media.Downloader
+	for _, dl := range dls {
+		if enabled[downloaderName(dl)] {
+			filtered = append(filtered, dl)
+		}
+	}
+
+	return filtered, nil
+}
+
 // processFiles calls processFile() for each filename in the given slice. It
-// processes the files in parallel, cfg.Jobs goroutines.
-func processFiles(ctx context.Context, cfg *Config, filenames []string) error {
-	s := download.NewStore(cfg.DestDir)
+// processes the files in parallel, cfg.Jobs goroutines. It records saved media
+// in the destination directory's manifest, and the outcome of every link in a
+// run report. A post or link that fails does not stop the run unless the
+// number of failures reaches cfg.MaxErrors. If the run stops early (ctx
+// cancelled or error limit reached), it abandons the posts in progress and
+// writes a checkpoint of the finished posts; the next run skips them. It
+// returns a *failures error if any post or link failed.
+func processFiles(ctx context.Context, cfg *Config, filenames []string) (err error) {
+	manifestPath := download.ManifestPath(cfg.DestDir)
+	manifest, err := download.LoadManifest(manifestPath)
+	if err != nil {
+		return fmt.Errorf("failed to load manifest: %w", err)
+	}
+	defer func() {
+		saveErr := manifest.Save(manifestPath)
+		if saveErr != nil && err == nil {
+			err = fmt.Errorf("failed to save manifest: %w", saveErr)
+		}
+	}()
+
+	rep := NewReport()
+	if prev, err := LoadReport(cfg.DestDir); err == nil {
+		rep.CarryOver(prev)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		log.WithError(err).Errorf("failed to load previous report; omitting the links of skipped posts")
+	}
+	defer func() {
+		saveErr := rep.Save(cfg.DestDir)
+		if saveErr != nil && err == nil {
+			err = fmt.Errorf("failed to save report: %w", saveErr)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	checkpointPath := CheckpointPath(cfg.DestDir)
+	cp, err := LoadCheckpoint(checkpointPath, cfg.Source)
+	if err != nil {
+		return fmt.Errorf("failed to load checkpoint: %w", err)
+	}
+	defer func() {
+		var cpErr error
+		if ctx.Err() != nil {
+			log.Infof("run stopped; saving checkpoint: path=%s", checkpointPath)
+			cpErr = cp.Save(checkpointPath)
+		} else {
+			cpErr = RemoveCheckpoint(checkpointPath)
+		}
+		if cpErr != nil && err == nil {
+			err = fmt.Errorf("failed to update checkpoint: %w", cpErr)
+		}
+	}()
+
+	hc, err := cfg.httpClient()
+	if err != nil {
+		return err
+	}
+	if cfg.Offline {
+		hc = download.NewOfflineClient()
+	}
+
+	s := download.NewStore(cfg.DestDir, manifest, hc)
+	dls, err := newDownloaders(cfg, s)
+	if err != nil {
+		return err
+	}
+
+	sc := &scraper{
+		cfg:    cfg,
+		s:      s,
+		dls:    dls,
+		man:    manifest,
+		rep:    rep,
+		fails:  newFailures(cfg.MaxErrors, cancel),
+		calls:  map[string]*linkCall{},
+		active: map[*linkCall]struct{}{},
+	}
+	if cfg.Wayback {
+		sc.wb = wayback.NewDownloader(s, wayback.DefaultAPIURL, cfg.MaxMediaSize)
+	}
+
 	g := &errgroup.Group{}
 
 	startGoroutines := func() {
@@ -33,11 +223,10 @@ func processFiles(ctx context.Context, cfg *Config, filenames []string) error {
 		for i := 0; i < cfg.Jobs; i++ {
 			g.Go(func() error {
 				// Read filenames from the channel and process them
-				// sequentially. Proceed until error or channel closed.
+				// sequentially. Proceed until channel closed.
 				for filename := range filenameChan {
-					err := processFile(ctx, cfg, s, filename)
-					if err != nil {
-						return err
+					if sc.processFile(ctx, filename) {
+						cp.Add(filename)
 					}
 				}
 				return nil
@@ -46,6 +235,12 @@ func processFiles(ctx context.Context, cfg *Config, filenames []string) error {
 
 		// Process bdfr posts.
 		for _, filename := range filenames {
+			if cp.Has(filename) {
+				log.Debugf("skipping post finished by an earlier run: filename=%s", filename)
+				sc.rep.AddSkipped(filename)
+				continue
+			}
+
 			select {
 			case <-ctx.Done():
 				// Operation aborted. Return early to execute deferred channel
@@ -59,115 +254,529 @@ func processFiles(ctx context.Context, cfg *Config, filenames []string) error {
 
 	startGoroutines()
 
-	return g.Wait()
+	err = g.Wait()
+	if err != nil {
+		return err
+	}
+
+	rep.Failures = sc.fails.Strings()
+	return sc.fails.Err()
 }
 
 // processFile reads the given saved bdfr post from disk, processes it with
 // processPost(), and writes the processed content to disk in the configured
-// destination directory.
-func processFile(ctx context.Context, cfg *Config, s *download.Store, filename string) error {
-	m, err := bdfr.ReadMessage(cfg.Source + "/" + filename)
+// destination directory. It records a failure if any step fails. If the run
+// stops while the post is in progress, it abandons the post without writing
+// it. Unless cfg.Full or cfg.Offline is set, it skips a post that is
+// unchanged since a previous run resolved all of its links. It returns true if
+// it wrote or skipped the processed post.
+func (sc *scraper) processFile(ctx context.Context, filename string) bool {
+	src := linkSource{
+		File: filename,
+	}
+
+	fail := func(err error) {
+		log.WithError(err).Errorf("failed to process post: filename=%s", filename)
+		sc.fails.AddPost(src, err)
+	}
+
+	srcPath := sc.cfg.Source + "/" + filename
+	info, err := os.Stat(srcPath)
 	if err != nil {
-		return err
+		fail(err)
+		return false
+	}
+
+	prev, havePrev := sc.reusablePost(filename)
+
+	// Cheap check first: same size and modification time.
+	if havePrev && statUnchanged(prev, info) {
+		log.Debugf("skipping unchanged post: filename=%s", filename)
+		sc.rep.AddSkipped(filename)
+		return true
 	}
 
+	b, err := os.ReadFile(srcPath)
+	if err != nil {
+		fail(err)
+		return false
+	}
+
+	sum := sha256.Sum256(b)
+	entry := download.PostEntry{
+		Size:    int64(len(b)),
+		ModTime: info.ModTime(),
+		SHA256:  hex.EncodeToString(sum[:]),
+	}
+
+	// The file was touched, but its contents are the same.
+	if havePrev && prev.SHA256 == entry.SHA256 {
+		log.Debugf("skipping unchanged post: filename=%s", filename)
+		sc.rep.AddSkipped(filename)
+		entry.Resolved = true
+		entry.LinkPrefix = &sc.cfg.LinkPrefix
+		entry.KeepOriginal = &sc.cfg.KeepOriginal
+		sc.man.UpdatePost(filename, entry)
+		return true
+	}
+
+	m, err := bdfr.ParseMessage(b)
+	if err != nil {
+		fail(err)
+		return false
+	}
+	src.PostID = m.GetString("id")
+
 	log.Debugf("processing post: filename=%s", filename)
-	err = processPost(ctx, s, m)
+	unresolved, err := sc.processPost(ctx, filename, m)
 	if err != nil {
-		return err
+		fail(err)
+		return false
+	}
+
+	if ctx.Err() != nil {
+		log.Infof("run stopped; abandoning post: filename=%s", filename)
+		return false
 	}
 
-	b, err := json.Marshal(m)
+	out, err := json.Marshal(m)
 	if err != nil {
-		return err
+		fail(err)
+		return false
 	}
 
-	err = os.WriteFile(cfg.DestDir+"/"+filename, b, 0644)
+	err = fileutil.WriteFileAtomic(sc.cfg.DestDir+"/"+filename, out, 0644)
 	if err != nil {
-		return err
+		fail(err)
+		return false
 	}
 
-	return nil
+	entry.Resolved = unresolved == 0
+	entry.LinkPrefix = &sc.cfg.LinkPrefix
+	entry.KeepOriginal = &sc.cfg.KeepOriginal
+	sc.man.UpdatePost(filename, entry)
+	sc.rep.AddPost(filename)
+
+	return true
+}
+
+// reusablePost returns the manifest entry of the given source post if its
+// processed copy may be kept as is, provided the source is unchanged: a
+// previous run processed it with the current link prefix and keep-original
+// mode, resolved all of its links, and the processed copy still exists. It
+// returns false if cfg.Full or cfg.Offline is set.
+func (sc *scraper) reusablePost(filename string) (download.PostEntry, bool) {
+	if sc.cfg.Full || sc.cfg.Offline {
+		return download.PostEntry{}, false
+	}
+
+	prev, ok := sc.man.LookupPost(filename)
+	if !ok || !prev.Resolved ||
+		prev.LinkPrefix == nil || *prev.LinkPrefix != sc.cfg.LinkPrefix ||
+		prev.KeepOriginal == nil || *prev.KeepOriginal != sc.cfg.KeepOriginal {
+		return download.PostEntry{}, false
+	}
+
+	if !fileutil.FileExists(sc.cfg.DestDir + "/" + filename) {
+		return download.PostEntry{}, false
+	}
+
+	return prev, true
+}
+
+// statUnchanged returns true if a source post has the size and modification
+// time that the given manifest entry records.
+func statUnchanged(prev download.PostEntry, info os.FileInfo) bool {
+	return prev.Size == info.Size() && prev.ModTime.Equal(info.ModTime())
 }
 
 // processPost saves external media referenced by the given bdfr post and its
 // comments, then updates the message bodies such that they link to the local
 // media instead. That is, it makes a given reddit post fully self-contained
-// and localized.
-func processPost(ctx context.Context, s *download.Store, m bdfr.Message) error {
-	selftext := m.GetString("selftext")
-	m.SetString("selftext", processBody(ctx, s, selftext))
+// and localized. The filename parameter is the name of the post's file, for
+// the run report. It returns the number of links that failed to save or, in
+// an offline run, that still need downloading.
+func (sc *scraper) processPost(ctx context.Context, filename string, m bdfr.Message) (int, error) {
+	created := m.GetTime("created_utc")
+
+	unresolved := 0
+	err := walkPost(filename, m, func(msg bdfr.Message, src linkSource, mdKey string, htmlKey string) error {
+		unresolved += sc.processMessage(ctx, msg, src, mdKey, htmlKey, created)
+		return nil
+	})
+
+	return unresolved, err
+}
 
-	comments, err := m.GetSliceOfMessages("comments")
-	if err != nil {
-		return err
+// Ways of keeping a link's original url visible after processBody rewrites
+// it to point at local media. See Config.KeepOriginal.
+const (
+	keepNone     = ""         // Original url is dropped.
+	keepFootnote = "footnote" // Original url goes in a reference link after the rewritten link, defined at the end of the message.
+	keepTitle    = "title"    // Original url becomes the link's title.
+	keepArray    = "array"    // Original url goes in the message's bdfrscrape_links array.
+)
+
+// linkStatus describes what became of a link.
+type linkStatus string
+
+const (
+	statusSaved       linkStatus = "saved"       // Media downloaded by this run.
+	statusCached      linkStatus = "cached"      // Media already on disk.
+	statusUnsupported linkStatus = "unsupported" // No downloader claimed the link.
+	statusFailed      linkStatus = "failed"      // A downloader claimed the link but failed.
+	statusPending     linkStatus = "pending"     // Offline runs only: a downloader claims the link, but its media isn't on disk.
+)
+
+// linkResult records the outcome of resolving one link.
+type linkResult struct {
+	URL    string     // Link url, with entities and escapes resolved.
+	Path   string     // Local path of the media, relative to the destination directory. Empty unless saved or cached.
+	Link   string     // Link to the local media, for rewriting (cfg.LinkPrefix + Path). Empty if Path is.
+	Status linkStatus // Outcome.
+	Err    error      // Non-nil if Status is statusFailed.
+
+	Downloader string        // Name of the downloader that claimed the link. Empty if unsupported.
+	Bytes      int64         // Number of bytes fetched from the network.
+	Duration   time.Duration // Time spent resolving the link.
+}
+
+// resolveLink saves the media at the given link and reports the outcome. In
+// an offline run, it only looks for media already on disk. The src parameter
+// identifies the message containing the link, for recording a failure.
+//
+// Each link is resolved once per run. If another message's resolution of the
+// link is in progress or done, resolveLink waits for it and reports the same
+// outcome, without counting a failure a second time.
+func (sc *scraper) resolveLink(ctx context.Context, src linkSource, link string, created time.Time) *linkResult {
+	sc.callsMtx.Lock()
+	call, dup := sc.calls[link]
+	if !dup {
+		call = &linkCall{done: make(chan struct{})}
+		sc.calls[link] = call
+		sc.active[call] = struct{}{}
 	}
+	sc.callsMtx.Unlock()
+
+	if dup {
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return &linkResult{
+				URL:    link,
+				Status: statusFailed,
+				Err:    ctx.Err(),
+			}
+		}
 
-	for _, c := range comments {
-		processComment(ctx, s, c)
+		r := *call.res
+		r.Bytes = 0
+		r.Duration = 0
+		if r.Status == statusSaved {
+			r.Status = statusCached
+		}
+		return &r
 	}
 
-	return nil
+	r := sc.resolveOnce(ctx, src, link, created, call)
+
+	sc.callsMtx.Lock()
+	delete(sc.active, call)
+	sc.callsMtx.Unlock()
+
+	call.res = r
+	close(call.done)
+
+	return r
 }
 
-// processComment saves external media referenced by the given bdfr comment,
-// then updates its message body such that it links to the local media instead.
-func processComment(ctx context.Context, s *download.Store, c bdfr.Message) error {
-	body := processBody(ctx, s, c.GetString("body"))
-	c.SetString("body", body)
+// awaitOthers waits for the link resolutions in progress, other than call, to
+// finish. It doesn't wait for those that are themselves waiting, so two
+// resolutions never wait for each other.
+func (sc *scraper) awaitOthers(ctx context.Context, call *linkCall) {
+	sc.callsMtx.Lock()
+	call.waiting = true
+	var others []*linkCall
+	for c := range sc.active {
+		if c != call && !c.waiting {
+			others = append(others, c)
+		}
+	}
+	sc.callsMtx.Unlock()
 
-	replies, err := c.GetSliceOfMessages("replies")
-	if err != nil {
-		return err
+	for _, c := range others {
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+		}
+	}
+
+	sc.callsMtx.Lock()
+	call.waiting = false
+	sc.callsMtx.Unlock()
+}
+
+// resolveOnce does the work of resolveLink for the first message that holds
+// the link.
+func (sc *scraper) resolveOnce(ctx context.Context, src linkSource, link string, created time.Time, call *linkCall) *linkResult {
+	ctx, st := download.WithStats(ctx)
+
+	start := time.Now()
+	var localPath, dlName string
+	var err error
+	if sc.cfg.Offline {
+		localPath, dlName = sc.lookupMedia(link)
+	} else {
+		localPath, dlName, err = sc.downloadMedia(ctx, link, created)
+		if errors.Is(err, download.AlreadyAttempted) {
+			// Another link leads to the same media (e.g., another form of the
+			// same url). Once the other resolutions finish, the media is
+			// either on disk or failed under the other link, which counted
+			// the failure.
+			sc.awaitOthers(ctx, call)
+			localPath, dlName, err = sc.downloadMedia(ctx, link, created)
+		}
+	}
+
+	r := &linkResult{
+		URL:        link,
+		Downloader: dlName,
+		Bytes:      st.Bytes(),
+		Duration:   time.Since(start),
+	}
+
+	switch {
+	case err != nil:
+		log.WithError(err).Errorf("failed to save link: link=%s", link)
+		r.Status = statusFailed
+		r.Err = err
+
+		// Downloads that fail because the run stopped aren't the link's
+		// fault.
+		if ctx.Err() == nil && !errors.Is(err, download.AlreadyAttempted) {
+			sc.fails.AddLink(src, link, err)
+		}
+
+	case localPath == "" && sc.cfg.Offline && dlName != "":
+		r.Status = statusPending
+
+	case localPath == "":
+		r.Status = statusUnsupported
+
+	case r.Bytes > 0:
+		r.Status = statusSaved
+		r.Path = localPath
+
+	default:
+		r.Status = statusCached
+		r.Path = localPath
 	}
 
-	for _, r := range replies {
-		err := processComment(ctx, s, r)
-		if err != nil {
-			return err
+	if r.Path != "" {
+		r.Link = sc.cfg.LinkPrefix + r.Path
+
+		// Downloaders may save the media under another url than the link
+		// (e.g., a normalized one). Remember the link so that an offline run
+		// finds the media by it.
+		if !sc.cfg.Offline {
+			sc.man.AddAlias(r.Path, link)
 		}
 	}
 
-	return nil
+	return r
 }
 
-// processBody saves external media referenced in the given post or comment
-// body, then updates the body such that it links to the local media instead.
-// It returns the modified message body.
-func processBody(ctx context.Context, s *download.Store, body string) string {
-	processLink := func(link string) {
-		localPath, err := downloadMedia(ctx, s, link)
-		if err != nil {
-			log.WithError(err).Errorf("failed to save link: link=%s", link)
-			return
+// processMessage saves external media referenced by a post or comment, then
+// rewrites both the markdown body (mdKey) and, if bdfr saved one, its html
+// rendering (htmlKey), such that they link to the same local media. The
+// src parameter identifies the message for the run report. The created
+// parameter is the creation time of the post that the message belongs to. It
+// returns the number of links that failed to save or, in an offline run, that
+// still need downloading.
+func (sc *scraper) processMessage(ctx context.Context, m bdfr.Message, src linkSource, mdKey string, htmlKey string, created time.Time) int {
+	// Results of links already resolved in this message, in order of first
+	// appearance.
+	resolved := map[string]*linkResult{}
+	var order []*linkResult
+
+	resolve := func(link string) *linkResult {
+		r, ok := resolved[link]
+		if !ok {
+			r = sc.resolveLink(ctx, src, link, created)
+			resolved[link] = r
+			order = append(order, r)
+			sc.rep.Add(src, r)
+		}
+		return r
+	}
+
+	mode := sc.cfg.KeepOriginal
+
+	m.SetString(mdKey, processBody(m.GetString(mdKey), mode, resolve))
+
+	if body := m.GetString(htmlKey); body != "" {
+		m.SetString(htmlKey, processHTML(body, mode, resolve))
+	}
+
+	if mode == keepArray && len(order) > 0 {
+		var links []map[string]any
+		for _, r := range order {
+			l := map[string]any{
+				"url":    r.URL,
+				"status": string(r.Status),
+			}
+			if r.Path != "" {
+				l["path"] = r.Path
+			}
+			if r.Err != nil {
+				l["error"] = r.Err.Error()
+			}
+			links = append(links, l)
+		}
+		m["bdfrscrape_links"] = links
+	}
+
+	unresolved := 0
+	for _, r := range order {
+		if r.Status == statusFailed || r.Status == statusPending {
+			unresolved++
 		}
-		if localPath == "" {
+	}
+	return unresolved
+}
+
+// processHTML updates the link and media urls in the given html rendering of
+// a message body such that they point to local media. The resolve function
+// saves the media at a url and reports the outcome. Unless mode is keepNone
+// or keepArray, each rewritten element gets its original url as its title. It
+// returns the modified html.
+func processHTML(body string, mode string, resolve func(link string) *linkResult) string {
+	modded, err := web.RewriteURLs(body, func(link string) (string, string, bool) {
+		pu, err := url.Parse(link)
+		if err != nil || (pu.Scheme != "http" && pu.Scheme != "https") {
+			return "", "", false
+		}
+
+		r := resolve(link)
+		if r.Path == "" {
+			return "", "", false
+		}
+
+		var title string
+		if mode == keepFootnote || mode == keepTitle {
+			title = link
+		}
+
+		mdlink := r.Link
+		log.Debugf("replacing html link: %s --> %s", link, mdlink)
+		return mdlink, title, true
+	})
+	if err != nil {
+		log.WithError(err).Errorf("failed to rewrite html body")
+		return body
+	}
+
+	return modded
+}
+
+// processBody updates the given post or comment body such that its links
+// point to local media. The resolve function saves the media at a url and
+// reports the outcome. Resolve sees each url with html entities and markdown
+// escapes resolved, while rewriting replaces the url exactly as written. The
+// mode parameter says how to keep the original urls visible (see
+// Config.KeepOriginal). It returns the modified message body.
+func processBody(body string, mode string, resolve func(link string) *linkResult) string {
+	var footnotes []string
+
+	links := markdown.Links(body)
+
+	body = markdown.Rewrite(body, links, func(l markdown.Link) (markdown.Edit, bool) {
+		r := resolve(l.URL)
+		if r.Path == "" {
 			// Don't know how to save this link to disk. Ignore.
-			return
+			return markdown.Edit{}, false
 		}
 
 		// mdlink is the the url of the local copy of the media file.
-		mdlink := "media/" + localPath
-
-		// Update the link in the message body to point to the local media
-		modded := strings.Replace(body, "]("+link+")", "]("+mdlink+")", -1)
-		if modded != body {
-			// Message contains an embedded markdown link to the media file.
-			log.Debugf("replacing markdown link: (%s) --> (%s)", link, mdlink)
-			body = modded
-		} else {
+		mdlink := r.Link
+
+		// A link that already has a title keeps it; its original url goes in
+		// a footnote instead.
+		useTitle := mode == keepTitle && !l.HasTitle
+		useFootnote := mode == keepFootnote || (mode == keepTitle && l.HasTitle)
+		mdTitle := ` "` + strings.ReplaceAll(l.URL, `"`, `\"`) + `"`
+
+		if l.Kind == markdown.Reference && useFootnote {
+			// Nothing may follow a reference definition's title, and an
+			// untitled definition would take a footnote link for its
+			// title. The original url becomes the title if there is none,
+			// else a definition of its own.
+			useTitle = !l.HasTitle
+			useFootnote = false
+			if l.HasTitle {
+				footnotes = append(footnotes, l.Raw)
+			}
+		}
+
+		var e markdown.Edit
+
+		switch l.Kind {
+		case markdown.Bare:
 			// Message contains a raw url.
-			rawlink := fmt.Sprintf(`<a href="media/%s">%s</a>`, localPath, link)
-			log.Debugf("replacing raw link: %s --> %s", link, rawlink)
-			body = strings.Replace(body, link, rawlink, -1)
+			if useTitle {
+				e.Text = fmt.Sprintf(`<a href="%s" title="%s">%s</a>`, mdlink, html.EscapeString(l.URL), l.Raw)
+			} else {
+				e.Text = fmt.Sprintf(`<a href="%s">%s</a>`, mdlink, l.Raw)
+			}
+			log.Debugf("replacing raw link: %s --> %s", l.URL, e.Text)
+
+		case markdown.Autolink:
+			// Message contains a url in angle brackets. Keep the url as the
+			// link text.
+			if useTitle {
+				e.Text = fmt.Sprintf("[%s](%s%s)", l.Raw, mdlink, mdTitle)
+			} else {
+				e.Text = fmt.Sprintf("[%s](%s)", l.Raw, mdlink)
+			}
+			log.Debugf("replacing autolink: <%s> --> %s", l.URL, e.Text)
+
+		case markdown.Reference:
+			// Message contains a link reference definition. Replace only its
+			// destination; a title goes after any angle brackets around it.
+			e.Text = mdlink
+			if useTitle {
+				e.Suffix = mdTitle
+			}
+			log.Debugf("replacing reference definition: %s --> %s", l.URL, mdlink)
+
+		default:
+			// Message contains a markdown link to the media file. Replace
+			// only its destination.
+			e.Text = mdlink
+			if useTitle {
+				e.Text += mdTitle
+			}
+			log.Debugf("replacing markdown link: (%s) --> (%s)", l.URL, mdlink)
+		}
+
+		if useFootnote {
+			// Plain markdown reference links, unlike GFM footnotes, render
+			// everywhere that the rest of the message does.
+			footnotes = append(footnotes, l.Raw)
+			e.Suffix = fmt.Sprintf(" ([original][bdfrscrape-%d])", len(footnotes))
 		}
-	}
 
-	rx := xurls.Strict()
-	links := rx.FindAllString(body, -1)
+		return e, true
+	})
 
-	for _, link := range links {
-		processLink(link)
+	if len(footnotes) > 0 {
+		sb := strings.Builder{}
+		sb.WriteString(body)
+		sb.WriteString("\n")
+		for i, f := range footnotes {
+			sb.WriteString(fmt.Sprintf("\n[bdfrscrape-%d]: %s", i+1, f))
+		}
+		body = sb.String()
 	}
 
 	return body
@@ -175,30 +784,69 @@ func processBody(ctx context.Context, s *download.Store, body string) string {
 
 // downloadMedia attempts to download the media file specified by the given
 // url. On success, it returns the local path of saved file, relative to
-// mdfrscrape's media directory. It is a no-op that appears successful if there
-// is already a file with the destination path (e.g., a previous invocation of
-// the tool already saved the file). It returns the empty string if it does
-// not know how to save the given url. It returns an error if it attempts and
-// fails to save the specified media file.
-func downloadMedia(ctx context.Context, s *download.Store, u string) (string, error) {
-	dls := []media.Downloader{
-		imgur.NewDownloader(s),
-		postimg.NewDownloader(s),
-		imgbb.NewDownloader(s),
-	}
-
+// mdfrscrape's media directory, and the name of the downloader that saved it.
+// It is a no-op that appears successful if there is already a file with the
+// destination path (e.g., a previous invocation of the tool already saved the
+// file). It returns empty strings if it does not know how to save the given
+// url. It returns an error if it attempts and fails to save the specified
+// media file. It tries each downloader in order until one claims the url. If
+// the claiming downloader fails permanently and the wayback fallback is
+// enabled, it tries to recover the capture closest to the given time from the
+// Wayback Machine.
+func (sc *scraper) downloadMedia(ctx context.Context, u string, created time.Time) (string, string, error) {
 	dlOnce := func(dl media.Downloader) (string, error) {
-		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		timeout := sc.cfg.Timeout
+		if t, ok := dl.(media.Timed); ok && t.Timeout(u) > 0 {
+			timeout = t.Timeout(u)
+		}
+		if hc, ok := sc.cfg.hostConfig(linkHost(u)); ok && hc.Timeout > 0 {
+			timeout = hc.Timeout
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, timeout)
 		defer cancel()
 
 		return dl.Download(ctx, u)
 	}
 
-	for _, dl := range dls {
+	for _, dl := range sc.dls {
 		filename, err := dlOnce(dl)
+		if err != nil && sc.wb != nil && download.IsPermanent(err) {
+			log.WithError(err).Infof("trying wayback fallback: url=%s", u)
+			filename, err := sc.recover(ctx, u, created)
+			return filename, downloaderName(sc.wb), err
+		}
 		if filename != "" || err != nil {
-			return filename, err
+			return filename, downloaderName(dl), err
 		}
 	}
-	return "", nil
+	return "", "", nil
+}
+
+// lookupMedia returns the local file already saved from url=u, and the name
+// of the downloader that would claim the url. Either may be empty. Besides
+// the url itself and the aliases that the manifest records, it tries the
+// canonical url of the claiming downloader. It makes no network requests.
+func (sc *scraper) lookupMedia(u string) (string, string) {
+	filename, ok := sc.s.Lookup(u)
+
+	for _, dl := range sc.dls {
+		if !dl.Claims(u) {
+			continue
+		}
+		if c, isCanon := dl.(media.Canonicalizer); isCanon && !ok {
+			filename, _ = sc.s.Lookup(c.CanonicalURL(u))
+		}
+		return filename, downloaderName(dl)
+	}
+
+	return filename, ""
+}
+
+// recover retrieves url=u from the wayback fallback.
+func (sc *scraper) recover(ctx context.Context, u string, created time.Time) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+
+	return sc.wb.Recover(ctx, u, created)
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"path"
+	"testing"
+)
+
+// localResolve stands in for scraper.resolveLink: it "saves" every link to a
+// file named after the last element of its path.
+func localResolve(link string) *linkResult {
+	filename := "_" + path.Base(link)
+	return &linkResult{
+		URL:    link,
+		Path:   filename,
+		Link:   "media/" + filename,
+		Status: statusSaved,
+	}
+}
+
+func TestProcessBodyKeepOriginal(t *testing.T) {
+	tests := []struct {
+		name string
+		mode string
+		body string
+		want string
+	}{
+		{
+			name: "footnote inline",
+			mode: keepFootnote,
+			body: "See [a](https://x.test/a.jpg).",
+			want: "See [a](media/_a.jpg) ([original][bdfrscrape-1]).\n" +
+				"\n[bdfrscrape-1]: https://x.test/a.jpg",
+		},
+		{
+			name: "footnote nested image",
+			mode: keepFootnote,
+			body: "[![t](https://x.test/t.jpg)](https://x.test/f.jpg) end",
+			want: "[![t](media/_t.jpg)](media/_f.jpg) ([original][bdfrscrape-1]) ([original][bdfrscrape-2]) end\n" +
+				"\n[bdfrscrape-1]: https://x.test/t.jpg" +
+				"\n[bdfrscrape-2]: https://x.test/f.jpg",
+		},
+		{
+			name: "footnote untitled definition",
+			mode: keepFootnote,
+			body: "[d][]\n\n[d]: https://x.test/d.jpg\n",
+			want: "[d][]\n\n[d]: media/_d.jpg \"https://x.test/d.jpg\"\n",
+		},
+		{
+			name: "footnote bracketed definition",
+			mode: keepFootnote,
+			body: "[d]: <https://x.test/d.jpg>",
+			want: "[d]: <media/_d.jpg> \"https://x.test/d.jpg\"",
+		},
+		{
+			name: "footnote titled definition",
+			mode: keepFootnote,
+			body: "[d]: https://x.test/d.jpg \"T\"\n",
+			want: "[d]: media/_d.jpg \"T\"\n\n" +
+				"\n[bdfrscrape-1]: https://x.test/d.jpg",
+		},
+		{
+			name: "title inline",
+			mode: keepTitle,
+			body: "[a](https://x.test/a.jpg)",
+			want: "[a](media/_a.jpg \"https://x.test/a.jpg\")",
+		},
+		{
+			name: "title titled inline",
+			mode: keepTitle,
+			body: "[a](https://x.test/a.jpg \"T\")",
+			want: "[a](media/_a.jpg \"T\") ([original][bdfrscrape-1])\n" +
+				"\n[bdfrscrape-1]: https://x.test/a.jpg",
+		},
+		{
+			name: "title untitled definition",
+			mode: keepTitle,
+			body: "[d]: https://x.test/d.jpg",
+			want: "[d]: media/_d.jpg \"https://x.test/d.jpg\"",
+		},
+		{
+			name: "title titled definition",
+			mode: keepTitle,
+			body: "[d]: https://x.test/d.jpg 'T'",
+			want: "[d]: media/_d.jpg 'T'\n" +
+				"\n[bdfrscrape-1]: https://x.test/d.jpg",
+		},
+		{
+			name: "url as link text",
+			mode: keepNone,
+			body: "[https://x.test/a.jpg](https://x.test/a.jpg) and https://x.test/b.jpg.",
+			want: "[https://x.test/a.jpg](media/_a.jpg) and <a href=\"media/_b.jpg\">https://x.test/b.jpg</a>.",
+		},
+		{
+			name: "title nested image",
+			mode: keepTitle,
+			body: "[![t](https://x.test/t.jpg \"T\")](https://x.test/f.jpg)",
+			want: "[![t](media/_t.jpg \"T\")](media/_f.jpg \"https://x.test/f.jpg\") ([original][bdfrscrape-1])\n" +
+				"\n[bdfrscrape-1]: https://x.test/t.jpg",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := processBody(tt.body, tt.mode, localResolve)
+			if got != tt.want {
+				t.Errorf("processBody(%q)\n got: %q\nwant: %q", tt.body, got, tt.want)
+			}
+		})
+	}
+}
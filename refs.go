@@ -0,0 +1,265 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ccollins476ad/bdfrscrape/bdfr"
+	"github.com/ccollins476ad/bdfrscrape/download"
+	"github.com/ccollins476ad/bdfrscrape/markdown"
+	"github.com/ccollins476ad/bdfrscrape/web"
+	log "github.com/sirupsen/logrus"
+)
+
+// mediaPrefix begins the name of every media file that bdfrscrape derives
+// from a url (see download.URLToFilename).
+const mediaPrefix = "_bdfrscrape_"
+
+// mediaRef is a link from a processed post, or from a gallery page, to a
+// local file.
+type mediaRef struct {
+	From     string // Post or gallery page that holds the link, relative to the destination directory.
+	Link     string // The link, as written.
+	Filename string // File that the link points to, relative to the destination directory.
+}
+
+// archiveGraph records which local files the processed posts in a destination
+// directory link to, directly or through gallery pages.
+type archiveGraph struct {
+	Posts      []string         // Processed posts, sorted.
+	Unreadable map[string]error // Posts that could not be parsed, and why.
+	Media      []string         // Files that bdfrscrape saved, sorted: those named like media or listed in the manifest.
+	Refs       []mediaRef       // Links from the posts and from the gallery pages they reach.
+	Referenced map[string]bool  // Files that some post reaches, along with their attribution sidecars.
+}
+
+// loadArchiveGraph reads every processed post in destDir and follows its
+// links to local media, and from there the links of any gallery pages. A
+// post's local links start with the prefix that the manifest records for it,
+// or with linkPrefix if the manifest records none. The man parameter also
+// identifies media files whose names aren't derived from a url.
+func loadArchiveGraph(destDir string, linkPrefix string, man *download.Manifest) (*archiveGraph, error) {
+	entries, err := os.ReadDir(destDir)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &archiveGraph{
+		Unreadable: map[string]error{},
+		Referenced: map[string]bool{},
+	}
+
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+
+		name := e.Name()
+		_, inManifest := man.Lookup(name)
+		switch {
+		case strings.HasPrefix(name, mediaPrefix) || inManifest:
+			g.Media = append(g.Media, name)
+		case strings.HasSuffix(name, ".json"):
+			g.Posts = append(g.Posts, name)
+		}
+	}
+	sort.Strings(g.Posts)
+	sort.Strings(g.Media)
+
+	// Referenced files that may be gallery pages, and so have links of their
+	// own.
+	var queue []string
+
+	ref := func(from string, link string, filename string) {
+		g.Refs = append(g.Refs, mediaRef{
+			From:     from,
+			Link:     link,
+			Filename: filename,
+		})
+		if !g.Referenced[filename] {
+			g.Referenced[filename] = true
+			g.Referenced[download.SidecarFilename(filename)] = true
+			queue = append(queue, filename)
+		}
+	}
+
+	for _, filename := range g.Posts {
+		prefix := linkPrefix
+		if e, ok := man.LookupPost(filename); ok && e.LinkPrefix != nil {
+			prefix = *e.LinkPrefix
+		}
+
+		m, err := bdfr.ReadMessage(filepath.Join(destDir, filename))
+		if err == nil {
+			err = walkPost(filename, m, func(msg bdfr.Message, src linkSource, mdKey string, htmlKey string) error {
+				links, err := localLinks(msg, mdKey, htmlKey)
+				if err != nil {
+					return err
+				}
+				for _, link := range links {
+					if f, ok := linkFilename(link, prefix); ok {
+						ref(filename, link, f)
+					}
+				}
+				return nil
+			})
+		}
+		if err != nil {
+			g.Unreadable[filename] = err
+		}
+	}
+
+	for len(queue) > 0 {
+		filename := queue[0]
+		queue = queue[1:]
+
+		names, err := readGallery(filepath.Join(destDir, filename))
+		if err != nil {
+			// A missing file shows up as a broken link; there is nothing to
+			// follow.
+			log.WithError(err).Debugf("can't read gallery: filename=%s", filename)
+			continue
+		}
+		for _, name := range names {
+			// Gallery pages link to files in the same directory, without a
+			// prefix.
+			if f, ok := linkFilename(name, ""); ok {
+				ref(filename, name, f)
+			}
+		}
+	}
+
+	return g, nil
+}
+
+// bindLinkPrefixFlags defines the -config and -link-prefix flags on fs. After
+// fs parses the command line, the returned function returns the link prefix
+// they select, for posts whose prefix the manifest doesn't record: the
+// -link-prefix flag if set, else the -config file's, else the default.
+func bindLinkPrefixFlags(fs *flag.FlagSet) func() (string, error) {
+	configPath := fs.String("config", "", "read the link prefix from the yaml `file` that the scrape used")
+	linkPrefix := fs.String("link-prefix", defaultConfig().LinkPrefix, "prefix of local media links, for posts whose prefix the manifest doesn't record")
+
+	return func() (string, error) {
+		set := false
+		fs.Visit(func(f *flag.Flag) {
+			if f.Name == "link-prefix" {
+				set = true
+			}
+		})
+		if set {
+			return *linkPrefix, nil
+		}
+
+		cfg := defaultConfig()
+		if *configPath != "" {
+			err := loadConfigFile(*configPath, cfg)
+			if err != nil {
+				return "", err
+			}
+		}
+		return cfg.LinkPrefix, nil
+	}
+}
+
+// localLinks returns every distinct link in the given message's markdown body
+// (mdKey) and html rendering (htmlKey), including the links in the markdown
+// body's inline html, which is where processBody puts rewritten bare urls.
+func localLinks(m bdfr.Message, mdKey string, htmlKey string) ([]string, error) {
+	var links []string
+	seen := map[string]bool{}
+
+	add := func(link string) {
+		if !seen[link] {
+			seen[link] = true
+			links = append(links, link)
+		}
+	}
+
+	md := m.GetString(mdKey)
+	for _, l := range markdown.Links(md) {
+		add(l.URL)
+	}
+
+	for _, body := range []string{md, m.GetString(htmlKey)} {
+		if body == "" {
+			continue
+		}
+		urls, err := web.FragmentURLs(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse html body: %w", err)
+		}
+		for _, u := range urls {
+			add(u)
+		}
+	}
+
+	return links, nil
+}
+
+// linkFilename returns the local file that the given link points to, relative
+// to the destination directory, if the link is one that the scrape wrote:
+// relative and starting with linkPrefix. If linkPrefix is empty, the link
+// must also name a file derived from a url, since any relative link would
+// otherwise qualify.
+func linkFilename(link string, linkPrefix string) (string, bool) {
+	if !strings.HasPrefix(link, linkPrefix) {
+		return "", false
+	}
+
+	pu, err := url.Parse(link)
+	if err != nil || pu.Scheme != "" || pu.Host != "" {
+		return "", false
+	}
+
+	rel := strings.TrimPrefix(link, linkPrefix)
+	if rel == "" || strings.HasPrefix(rel, "/") {
+		return "", false
+	}
+
+	rel = path.Clean(rel)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false
+	}
+
+	if linkPrefix == "" && !strings.HasPrefix(path.Base(rel), mediaPrefix) {
+		return "", false
+	}
+
+	return rel, true
+}
+
+// readGallery returns the filenames that the gallery page at the given path
+// displays. It returns nil if the file isn't a gallery page.
+func readGallery(filePath string) ([]string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Only read the rest of the file if it begins like a gallery; most media
+	// files are large and aren't galleries.
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if !web.IsGallery(head[:n]) {
+		return nil, nil
+	}
+
+	rest, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return web.GalleryFilenames(string(head[:n]) + string(rest))
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ccollins476ad/bdfrscrape/download"
+	"github.com/ccollins476ad/bdfrscrape/fileutil"
+)
+
+// linkSource identifies the message that a link was found in.
+type linkSource struct {
+	File      string // Name of the post file, relative to the source directory.
+	PostID    string // Reddit id of the post.
+	CommentID string // Reddit id of the comment. Empty if the link is in the post body.
+	Permalink string // Reddit permalink of the post or comment.
+}
+
+// ReportLink is one row of the run report: the outcome of one link found in
+// one message.
+type ReportLink struct {
+	URL        string     `json:"url"`
+	Host       string     `json:"host"`
+	File       string     `json:"file"`
+	PostID     string     `json:"post_id"`
+	CommentID  string     `json:"comment_id,omitempty"`
+	Permalink  string     `json:"permalink,omitempty"`
+	Downloader string     `json:"downloader,omitempty"`
+	Status     linkStatus `json:"status"`
+	Path       string     `json:"path,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Bytes      int64      `json:"bytes"`
+	DurationMS int64      `json:"duration_ms"`
+	Carried    bool       `json:"carried,omitempty"` // True if copied from the previous report for a post that this run skipped.
+}
+
+// ReportHost totals the outcomes of the links to one host.
+type ReportHost struct {
+	Host        string `json:"host"`
+	Links       int    `json:"links"`
+	Saved       int    `json:"saved"`
+	Cached      int    `json:"cached"`
+	Unsupported int    `json:"unsupported"`
+	Failed      int    `json:"failed"`
+	Pending     int    `json:"pending"`
+	Bytes       int64  `json:"bytes"`
+	DurationMS  int64  `json:"duration_ms"`
+}
+
+// Report describes what a run did with every link it found. The scraper
+// goroutines add to it concurrently.
+type Report struct {
+	Started  time.Time    `json:"started"`
+	Finished time.Time    `json:"finished"`
+	Links    []ReportLink `json:"links"`
+	Hosts    []ReportHost `json:"hosts"`
+	Failures []string     `json:"failures,omitempty"` // Every post and link failure, with context.
+	Posts    []string     `json:"posts"`              // Posts written or skipped, whose links the report holds (unless omitted).
+	Skipped  int          `json:"skipped_posts"`      // Number of posts skipped as unchanged or finished by an interrupted run.
+	Omitted  int          `json:"omitted_posts"`      // Number of skipped posts that the previous report lacks, and whose links this report therefore lacks.
+
+	mtx       sync.Mutex
+	prevPosts map[string]bool         // Posts that the previous report holds.
+	prevLinks map[string][]ReportLink // Links of the previous report, by post file.
+}
+
+// ReportPath returns the path of the run report inside the given destination
+// directory, with the given extension ("json" or "csv").
+func ReportPath(destDir string, ext string) string {
+	return filepath.Join(destDir, download.StateDirName, "report."+ext)
+}
+
+func NewReport() *Report {
+	return &Report{
+		Started: time.Now().UTC(),
+	}
+}
+
+// CarryOver makes AddSkipped copy the links of skipped posts from prev, the
+// report of the previous run.
+func (r *Report) CarryOver(prev *Report) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.prevPosts = map[string]bool{}
+	r.prevLinks = map[string][]ReportLink{}
+	for _, file := range prev.Posts {
+		r.prevPosts[file] = true
+	}
+	for _, l := range prev.Links {
+		r.prevPosts[l.File] = true
+		r.prevLinks[l.File] = append(r.prevLinks[l.File], l)
+	}
+}
+
+// AddPost records a post that the run wrote.
+func (r *Report) AddPost(file string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.Posts = append(r.Posts, file)
+}
+
+// AddSkipped records a post that the run skipped, along with the outcomes of
+// its links as the previous report recorded them. Media that the previous run
+// saved is cached as far as this run is concerned.
+func (r *Report) AddSkipped(file string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.Skipped++
+	if !r.prevPosts[file] {
+		r.Omitted++
+		return
+	}
+
+	r.Posts = append(r.Posts, file)
+	for _, l := range r.prevLinks[file] {
+		if l.Status == statusSaved {
+			l.Status = statusCached
+		}
+		l.Bytes = 0
+		l.DurationMS = 0
+		l.Carried = true
+		r.Links = append(r.Links, l)
+	}
+}
+
+// Add records the outcome of a link.
+func (r *Report) Add(src linkSource, lr *linkResult) {
+	rl := ReportLink{
+		URL:        lr.URL,
+		Host:       linkHost(lr.URL),
+		File:       src.File,
+		PostID:     src.PostID,
+		CommentID:  src.CommentID,
+		Permalink:  src.Permalink,
+		Downloader: lr.Downloader,
+		Status:     lr.Status,
+		Path:       lr.Path,
+		Bytes:      lr.Bytes,
+		DurationMS: lr.Duration.Milliseconds(),
+	}
+	if lr.Err != nil {
+		rl.Error = lr.Err.Error()
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.Links = append(r.Links, rl)
+}
+
+// finish stamps the report's finish time and computes its per-host totals.
+func (r *Report) finish() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.Finished = time.Now().UTC()
+	sort.Strings(r.Posts)
+
+	hosts := map[string]*ReportHost{}
+	for _, l := range r.Links {
+		h := hosts[l.Host]
+		if h == nil {
+			h = &ReportHost{Host: l.Host}
+			hosts[l.Host] = h
+		}
+
+		h.Links++
+		h.Bytes += l.Bytes
+		h.DurationMS += l.DurationMS
+
+		switch l.Status {
+		case statusSaved:
+			h.Saved++
+		case statusCached:
+			h.Cached++
+		case statusUnsupported:
+			h.Unsupported++
+		case statusFailed:
+			h.Failed++
+		case statusPending:
+			h.Pending++
+		}
+	}
+
+	r.Hosts = nil
+	for _, h := range hosts {
+		r.Hosts = append(r.Hosts, *h)
+	}
+	sort.Slice(r.Hosts, func(i, j int) bool {
+		if r.Hosts[i].Links != r.Hosts[j].Links {
+			return r.Hosts[i].Links > r.Hosts[j].Links
+		}
+		return r.Hosts[i].Host < r.Hosts[j].Host
+	})
+}
+
+// Save writes the report to the given destination directory's state
+// directory, both as json and as csv. The csv file lists only the links; the
+// per-host totals are in the json file.
+func (r *Report) Save(destDir string) error {
+	r.finish()
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	err := os.MkdirAll(filepath.Join(destDir, download.StateDirName), 0755)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = fileutil.WriteFileAtomic(ReportPath(destDir, "json"), b, 0644)
+	if err != nil {
+		return err
+	}
+
+	sb := &strings.Builder{}
+	w := csv.NewWriter(sb)
+	w.Write([]string{
+		"url", "host", "file", "post_id", "comment_id", "permalink",
+		"downloader", "status", "path", "error", "bytes", "duration_ms", "carried",
+	})
+	for _, l := range r.Links {
+		w.Write([]string{
+			l.URL, l.Host, l.File, l.PostID, l.CommentID, l.Permalink,
+			l.Downloader, string(l.Status), l.Path, l.Error,
+			strconv.FormatInt(l.Bytes, 10), strconv.FormatInt(l.DurationMS, 10),
+			strconv.FormatBool(l.Carried),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("failed to encode csv report: %w", err)
+	}
+
+	return fileutil.WriteFileAtomic(ReportPath(destDir, "csv"), []byte(sb.String()), 0644)
+}
+
+// linkHost returns the lower-case host name of the given url, or the empty
+// string if it does not parse.
+func linkHost(u string) string {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(pu.Hostname())
+}
+
+// downloaderName returns a short name for the given downloader: the name of
+// the package that implements it (e.g., "imgur").
+func downloaderName(dl any) string {
+	t := reflect.TypeOf(dl)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return path.Base(t.PkgPath())
+}
+
+// LoadReport reads the run report from the given destination directory's
+// state directory.
+func LoadReport(destDir string) (*Report, error) {
+	b, err := os.ReadFile(ReportPath(destDir, "json"))
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Report{}
+	err = json.Unmarshal(b, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Print writes a human-readable summary of the report to w: its per-host
+// totals, its failures, and the links that an offline run left to download.
+func (r *Report) Print(w io.Writer) error {
+	var total ReportHost
+	for _, h := range r.Hosts {
+		total.Links += h.Links
+		total.Saved += h.Saved
+		total.Cached += h.Cached
+		total.Unsupported += h.Unsupported
+		total.Failed += h.Failed
+		total.Pending += h.Pending
+		total.Bytes += h.Bytes
+		total.DurationMS += h.DurationMS
+	}
+	total.Host = "total"
+
+	fmt.Fprintf(w, "Run: %s - %s (%s)\n",
+		r.Started.Format(time.RFC3339), r.Finished.Format(time.RFC3339),
+		r.Finished.Sub(r.Started).Round(time.Second))
+	fmt.Fprintln(w)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "HOST\tLINKS\tSAVED\tCACHED\tUNSUPPORTED\tFAILED\tPENDING\tBYTES\tDURATION\t")
+	for _, h := range append(r.Hosts, total) {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%s\t\n",
+			h.Host, h.Links, h.Saved, h.Cached, h.Unsupported, h.Failed, h.Pending, h.Bytes,
+			(time.Duration(h.DurationMS) * time.Millisecond).Round(time.Millisecond))
+	}
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	if r.Skipped > 0 {
+		fmt.Fprintf(w, "\nSkipped %d posts unchanged since an earlier run; their links are counted as that run reported them.\n", r.Skipped)
+		if r.Omitted > 0 {
+			fmt.Fprintf(w, "The previous report lacks %d of them, so their links are omitted. Rerun with -full to count them.\n", r.Omitted)
+		}
+	}
+
+	if len(r.Failures) > 0 {
+		fmt.Fprintf(w, "\nFailures:\n")
+		for _, f := range r.Failures {
+			fmt.Fprintf(w, "  %s\n", f)
+		}
+	}
+
+	if pending := r.Pending(); len(pending) > 0 {
+		fmt.Fprintf(w, "\nStill to download:\n")
+		for _, u := range pending {
+			fmt.Fprintf(w, "  %s\n", u)
+		}
+	}
+
+	return nil
+}
+
+// Pending returns the distinct urls of the links that an offline run found
+// no local media for but that a downloader claims, sorted.
+func (r *Report) Pending() []string {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	var urls []string
+	seen := map[string]bool{}
+	for _, l := range r.Links {
+		if l.Status == statusPending && !seen[l.URL] {
+			seen[l.URL] = true
+			urls = append(urls, l.URL)
+		}
+	}
+	sort.Strings(urls)
+
+	return urls
+}
+
+// runReport implements the report command: it prints the run report of the
+// last scrape of a destination directory.
+func runReport(cmd *command, args []string) int {
+	flags := cmd.flagSet()
+	asJSON := flags.Bool("json", false, "print the full report as json")
+
+	posArgs, err := parseFlags(flags, args, "dest_dir")
+	if err != nil {
+		return usageError(flags, err)
+	}
+	destDir := posArgs[0]
+
+	if *asJSON {
+		b, err := os.ReadFile(ReportPath(destDir, "json"))
+		if err != nil {
+			printFatalError(err)
+			return 3
+		}
+		os.Stdout.Write(b)
+		return 0
+	}
+
+	r, err := LoadReport(destDir)
+	if err != nil {
+		printFatalError(fmt.Errorf("failed to load report: %w", err))
+		return 3
+	}
+
+	err = r.Print(os.Stdout)
+	if err != nil {
+		printFatalError(err)
+		return 3
+	}
+
+	return 0
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ccollins476ad/bdfrscrape/download"
+	log "github.com/sirupsen/logrus"
+)
+
+// archiveHandler serves the files in a destination directory. Processed posts
+// link to media as "media/<filename>", so it also serves every file under the
+// "/media/" prefix. It hides bdfrscrape's state directory.
+func archiveHandler(destDir string) http.Handler {
+	files := http.FileServer(http.Dir(destDir))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := path.Clean("/" + r.URL.Path)
+		if p == "/"+download.StateDirName || strings.HasPrefix(p, "/"+download.StateDirName+"/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		if strings.HasPrefix(p, "/media/") {
+			r2 := r.Clone(r.Context())
+			r2.URL.Path = strings.TrimPrefix(p, "/media")
+			files.ServeHTTP(w, r2)
+			return
+		}
+
+		files.ServeHTTP(w, r)
+	})
+}
+
+// runServe implements the serve command: it serves a destination directory
+// over http until interrupted.
+func runServe(cmd *command, args []string) int {
+	flags := cmd.flagSet()
+	addr := flags.String("addr", "localhost:8080", "address to listen on")
+
+	posArgs, err := parseFlags(flags, args, "dest_dir")
+	if err != nil {
+		return usageError(flags, err)
+	}
+	destDir := posArgs[0]
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{
+		Addr:    *addr,
+		Handler: archiveHandler(destDir),
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Infof("serving %s on http://%s/", destDir, *addr)
+	err = srv.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		printFatalError(err)
+		return 3
+	}
+
+	return 0
+}
@@ -1,46 +1,504 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
-	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ccollins476ad/bdfrscrape/download"
+	"github.com/ccollins476ad/bdfrscrape/media/extcmd"
+	"gopkg.in/yaml.v3"
 )
 
+// Config is the configuration of a scrape. It can be loaded from a yaml file
+// (see loadConfigFile), and command line flags override the file's settings.
 type Config struct {
-	Source  string // Path of directory containing source bdfr posts.
-	DestDir string // Destination directory to save media and processed posts to.
-	Verbose bool   // True for verbose output.
-	Jobs    int    // Number of jobs to run in parallel.
+	Source         string   `yaml:"-"`               // Path of directory containing source bdfr posts.
+	DestDir        string   `yaml:"-"`               // Destination directory to save media and processed posts to.
+	Verbose        bool     `yaml:"verbose"`         // True for verbose output.
+	Jobs           int      `yaml:"jobs"`            // Number of jobs to run in parallel.
+	AllowHosts     []string `yaml:"allow_hosts"`     // If non-empty, the direct downloader only fetches from these hosts.
+	DenyHosts      []string `yaml:"deny_hosts"`      // Generic downloaders never fetch from these hosts.
+	OpenGraphHosts []string `yaml:"opengraph_hosts"` // If non-empty, the opengraph downloader only reads pages from these hosts.
+	OpenGraphDeny  []string `yaml:"opengraph_deny"`  // Hosts whose pages the opengraph downloader never reads, besides DenyHosts.
+	MaxMediaSize   int64    `yaml:"max_size"`        // Largest file, in bytes, that generic downloaders will save.
+	Wayback        bool     `yaml:"wayback"`         // True to recover dead links from the Wayback Machine.
+	KeepOriginal   string   `yaml:"keep_original"`   // How to keep original urls after rewriting: "", "footnote", "title", or "array".
+	MaxErrors      int      `yaml:"max_errors"`      // Number of post and link failures that stops the run; 0 for no limit.
+	Full           bool     `yaml:"full"`            // True to reprocess posts that are unchanged since the last run.
+	DryRun         bool     `yaml:"-"`               // True to report what a run would do without doing it.
+	Offline        bool     `yaml:"-"`               // True to rewrite links from media already on disk, without network access.
+
+	ExecRules   []extcmd.Rule `yaml:"exec"`         // External commands that handle matching urls.
+	ExecTimeout time.Duration `yaml:"exec_timeout"` // Time limit for one external command.
+
+	Timeout      time.Duration `yaml:"timeout"`       // Time limit for saving one link, unless its host or downloader has its own.
+	AlbumTimeout time.Duration `yaml:"album_timeout"` // Time limit for saving one imgbb album, whose images are fetched one by one.
+
+	ShareTimeout time.Duration `yaml:"share_timeout"`  // Time limit for saving one share link or file-drop link (Dropbox, Google Drive, catbox, pixeldrain).
+	MaxShareSize int64         `yaml:"max_share_size"` // Largest file, in bytes, that the share-link and file-drop downloaders will save.
+
+	Proxy       string                `yaml:"proxy"`       // Url of the proxy for all requests; empty to use the environment's.
+	Downloaders []string              `yaml:"downloaders"` // Names of the enabled downloaders; empty for all.
+	LinkPrefix  string                `yaml:"link_prefix"` // Prepended to the filename of local media when rewriting links.
+	Hosts       map[string]HostConfig `yaml:"hosts"`       // Per-host settings, keyed by host (which also covers its subdomains).
 }
 
-func parseArgs() (*Config, error) {
-	verbose := flag.Bool("v", false, "verbose output")
-	jobs := flag.Int("j", 1, "jobs")
+// HostConfig holds the settings for requests to one host.
+type HostConfig struct {
+	Headers   map[string]string `yaml:"headers,omitempty"`    // Added to every request.
+	RateLimit float64           `yaml:"rate_limit,omitempty"` // Largest number of requests per second; 0 for no limit.
+	Timeout   time.Duration     `yaml:"timeout,omitempty"`    // Time limit for saving one link; 0 for the default.
+	Proxy     string            `yaml:"proxy,omitempty"`      // Url of the proxy for requests to the host.
+}
 
-	flag.Usage = usage
-	flag.Parse()
+// defaultOpenGraphDeny lists the hosts whose pages the opengraph downloader
+// skips unless told otherwise. Their meta tags describe the site or the
+// page's text rather than linked media, or their pages need a login or
+// scripts.
+var defaultOpenGraphDeny = []string{
+	"reddit.com",
+	"redd.it",
+	"youtube.com",
+	"youtu.be",
+	"twitter.com",
+	"x.com",
+	"facebook.com",
+	"instagram.com",
+	"tiktok.com",
+	"wikipedia.org",
+	"github.com",
+	"google.com",
+	"amazon.com",
+}
 
-	if len(flag.Args()) < 1 {
-		return nil, fmt.Errorf("missing required argument: source")
+// defaultConfig returns the configuration that applies when neither a
+// configuration file nor a flag says otherwise.
+func defaultConfig() *Config {
+	return &Config{
+		Jobs:          1,
+		OpenGraphDeny: append([]string(nil), defaultOpenGraphDeny...),
+		MaxMediaSize:  100 << 20,
+		ExecTimeout:   10 * time.Minute,
+		Timeout:       10 * time.Second,
+		AlbumTimeout:  5 * time.Minute,
+		ShareTimeout:  30 * time.Minute,
+		MaxShareSize:  4 << 30,
+		LinkPrefix:    "media/",
 	}
-	source := flag.Args()[0]
+}
+
+// envRegexp matches a "${NAME}" reference to an environment variable.
+var envRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces each "${NAME}" in s with the value of the environment
+// variable NAME. Unlike os.ExpandEnv, it leaves a bare "$" alone, so regular
+// expressions survive. It returns an error if a variable is not set.
+func expandEnv(s string) (string, error) {
+	var err error
+	expanded := envRegexp.ReplaceAllStringFunc(s, func(ref string) string {
+		name := envRegexp.FindStringSubmatch(ref)[1]
+		val, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable not set: %s", name)
+		}
+		return val
+	})
+	return expanded, err
+}
 
-	if len(flag.Args()) < 2 {
-		return nil, fmt.Errorf("missing required argument: dest_dir")
+// expandNodeEnv applies expandEnv to every scalar in the given yaml document.
+func expandNodeEnv(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		val, err := expandEnv(n.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", n.Line, err)
+		}
+		n.Value = val
 	}
-	destDir := flag.Args()[1]
+	for _, c := range n.Content {
+		err := expandNodeEnv(c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	return &Config{
-		Source:  source,
-		DestDir: destDir,
-		Verbose: *verbose,
-		Jobs:    *jobs,
+// loadConfigFile reads the yaml configuration file at the given path over
+// cfg. Keys that the file omits keep their current values. Any "${NAME}" in a
+// value is replaced by the environment variable NAME, so that secrets (e.g.,
+// authorization headers) need not be stored in the file.
+func loadConfigFile(path string, cfg *Config) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var doc yaml.Node
+	err = yaml.Unmarshal(b, &doc)
+	if err != nil {
+		return fmt.Errorf("failed to parse config file: path=%s err=%w", path, err)
+	}
+	if doc.Kind == 0 {
+		// Empty file.
+		return nil
+	}
+
+	err = expandNodeEnv(&doc)
+	if err != nil {
+		return fmt.Errorf("failed to expand config file: path=%s err=%w", path, err)
+	}
+
+	// Re-encode the expanded document so that a strict decoder can reject
+	// unknown keys; yaml.Node#Decode can't.
+	b, err = yaml.Marshal(&doc)
+	if err != nil {
+		return err
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	err = dec.Decode(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to decode config file: path=%s err=%w", path, err)
+	}
+
+	return nil
+}
+
+// validate checks the configuration for invalid values.
+func (cfg *Config) validate() error {
+	switch cfg.KeepOriginal {
+	case keepNone, keepFootnote, keepTitle, keepArray:
+	default:
+		return fmt.Errorf("invalid keep-original value: %q", cfg.KeepOriginal)
+	}
+
+	if cfg.MaxErrors < 0 {
+		return fmt.Errorf("invalid max-errors value: %d", cfg.MaxErrors)
+	}
+
+	if cfg.Jobs < 1 {
+		return fmt.Errorf("invalid jobs value: %d", cfg.Jobs)
+	}
+
+	for host, hc := range cfg.Hosts {
+		if hc.RateLimit < 0 {
+			return fmt.Errorf("invalid rate limit: host=%s rate_limit=%v", host, hc.RateLimit)
+		}
+	}
+
+	// Checks the downloader names. The downloaders never run, so they need no
+	// store.
+	_, err := newDownloaders(cfg, nil)
+	if err != nil {
+		return err
+	}
+
+	// Checks the proxies.
+	_, err = cfg.httpClient()
+	return err
+}
+
+// hostConfig returns the settings for the given host. If several entries
+// match, the longest wins.
+func (cfg *Config) hostConfig(host string) (HostConfig, bool) {
+	var best string
+	for pattern := range cfg.Hosts {
+		if download.HostMatches(host, pattern) && len(pattern) > len(best) {
+			best = pattern
+		}
+	}
+	if best == "" {
+		return HostConfig{}, false
+	}
+	return cfg.Hosts[best], true
+}
+
+// httpClient returns an http client that applies the configured proxies and
+// per-host settings.
+func (cfg *Config) httpClient() (*http.Client, error) {
+	parseProxy := func(s string) (*url.URL, error) {
+		if s == "" {
+			return nil, nil
+		}
+		return url.Parse(s)
+	}
+
+	proxy, err := parseProxy(cfg.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy: %w", err)
+	}
+
+	hosts := map[string]download.HostSettings{}
+	for host, hc := range cfg.Hosts {
+		hs := download.HostSettings{
+			RateLimit: hc.RateLimit,
+		}
+
+		if len(hc.Headers) > 0 {
+			hs.Header = http.Header{}
+			for k, v := range hc.Headers {
+				hs.Header.Set(k, v)
+			}
+		}
+
+		hs.Proxy, err = parseProxy(hc.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: host=%s err=%w", host, err)
+		}
+
+		hosts[host] = hs
+	}
+
+	return &http.Client{
+		Transport: download.NewTransport(proxy, hosts),
 	}, nil
 }
 
-func usage() {
-	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [option]... <source> <dest_dir>\n", filepath.Base(os.Args[0]))
-	fmt.Fprintf(flag.CommandLine.Output(), "Scrapes media links from a bdfr archive.\n")
-	flag.PrintDefaults()
+// redacted returns a copy of the configuration with header values and proxy
+// passwords hidden, for display.
+func (cfg *Config) redacted() *Config {
+	redactURL := func(s string) string {
+		pu, err := url.Parse(s)
+		if err != nil {
+			return s
+		}
+		return pu.Redacted()
+	}
+
+	c := *cfg
+	c.Proxy = redactURL(c.Proxy)
+
+	c.Hosts = map[string]HostConfig{}
+	for host, hc := range cfg.Hosts {
+		if len(hc.Headers) > 0 {
+			headers := map[string]string{}
+			for k := range hc.Headers {
+				headers[k] = "<redacted>"
+			}
+			hc.Headers = headers
+		}
+		hc.Proxy = redactURL(hc.Proxy)
+		c.Hosts[host] = hc
+	}
+
+	return &c
+}
+
+// splitList splits a comma-separated flag value into its non-empty elements.
+func splitList(s string) []string {
+	var elems []string
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e != "" {
+			elems = append(elems, e)
+		}
+	}
+	return elems
+}
+
+// bindConfigFlags defines the flags that configure a scrape on fs. After fs
+// parses the command line, the returned function builds the effective
+// configuration: the defaults, overridden by the -config file, overridden by
+// the flags that were set. It leaves Source and DestDir empty.
+func bindConfigFlags(fs *flag.FlagSet) func() (*Config, error) {
+	def := defaultConfig()
+
+	configPath := fs.String("config", "", "read settings from the yaml `file`; flags override it")
+	verbose := fs.Bool("v", def.Verbose, "verbose output")
+	jobs := fs.Int("j", def.Jobs, "jobs")
+	allowHosts := fs.String("allow-hosts", "", "comma-separated hosts that the direct downloader may fetch from (default all)")
+	denyHosts := fs.String("deny-hosts", "", "comma-separated hosts that generic downloaders may not fetch from")
+	openGraphHosts := fs.String("opengraph-hosts", "", "comma-separated hosts whose pages may be read for OpenGraph media tags (default all)")
+	openGraphDeny := fs.String("opengraph-deny", strings.Join(def.OpenGraphDeny, ","), "comma-separated hosts whose pages are never read for OpenGraph media tags; empty for none")
+	maxMediaSize := fs.Int64("max-size", def.MaxMediaSize, "largest file, in bytes, that generic downloaders will save")
+	wayback := fs.Bool("wayback", def.Wayback, "recover dead media links from the Wayback Machine")
+	var execRules []extcmd.Rule
+	fs.Func("exec", "run an external command for matching urls: `<regexp>=<command> [arg]...`, split at the last = before the first space (repeatable)", func(s string) error {
+		r, err := extcmd.ParseRule(s)
+		if err != nil {
+			return err
+		}
+		execRules = append(execRules, r)
+		return nil
+	})
+	keepOriginal := fs.String("keep-original", def.KeepOriginal, "keep original urls after rewriting links: `footnote`, title, or array")
+	failFast := fs.Bool("fail-fast", false, "stop at the first failed post or link (same as -max-errors 1)")
+	keepGoing := fs.Bool("keep-going", false, "never stop because of failed posts or links (default)")
+	maxErrors := fs.Int("max-errors", def.MaxErrors, "stop after this many failed posts and links (0 for no limit)")
+	full := fs.Bool("full", def.Full, "reprocess every post, even those unchanged since the last run")
+	dryRun := fs.Bool("dry-run", false, "print a json plan of what a run would do, without network access or writing anything")
+	offline := fs.Bool("offline", false, "rewrite links to media already on disk, without network access; reprocesses every post")
+	execTimeout := fs.Duration("exec-timeout", def.ExecTimeout, "time limit for one external command")
+	timeout := fs.Duration("timeout", def.Timeout, "time limit for saving one link")
+	albumTimeout := fs.Duration("album-timeout", def.AlbumTimeout, "time limit for saving one imgbb album")
+	shareTimeout := fs.Duration("share-timeout", def.ShareTimeout, "time limit for saving one dropbox, google drive, catbox or pixeldrain link")
+	maxShareSize := fs.Int64("max-share-size", def.MaxShareSize, "largest file, in bytes, that the share-link and file-drop downloaders will save")
+	proxy := fs.String("proxy", "", "proxy `url` for all requests (default from environment)")
+	downloaders := fs.String("downloaders", "", "comma-separated downloaders to enable (default all)")
+	linkPrefix := fs.String("link-prefix", def.LinkPrefix, "prepended to local media filenames when rewriting links")
+
+	return func() (*Config, error) {
+		cfg := defaultConfig()
+		if *configPath != "" {
+			err := loadConfigFile(*configPath, cfg)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		set := map[string]bool{}
+		fs.Visit(func(f *flag.Flag) {
+			set[f.Name] = true
+		})
+
+		if set["v"] {
+			cfg.Verbose = *verbose
+		}
+		if set["j"] {
+			cfg.Jobs = *jobs
+		}
+		if set["allow-hosts"] {
+			cfg.AllowHosts = splitList(*allowHosts)
+		}
+		if set["deny-hosts"] {
+			cfg.DenyHosts = splitList(*denyHosts)
+		}
+		if set["opengraph-hosts"] {
+			cfg.OpenGraphHosts = splitList(*openGraphHosts)
+		}
+		if set["opengraph-deny"] {
+			cfg.OpenGraphDeny = splitList(*openGraphDeny)
+		}
+		if set["max-size"] {
+			cfg.MaxMediaSize = *maxMediaSize
+		}
+		if set["wayback"] {
+			cfg.Wayback = *wayback
+		}
+		if set["exec"] {
+			cfg.ExecRules = execRules
+		}
+		if set["keep-original"] {
+			cfg.KeepOriginal = *keepOriginal
+		}
+		if set["max-errors"] {
+			cfg.MaxErrors = *maxErrors
+		}
+		if set["full"] {
+			cfg.Full = *full
+		}
+		if set["exec-timeout"] {
+			cfg.ExecTimeout = *execTimeout
+		}
+		if set["timeout"] {
+			cfg.Timeout = *timeout
+		}
+		if set["album-timeout"] {
+			cfg.AlbumTimeout = *albumTimeout
+		}
+		if set["share-timeout"] {
+			cfg.ShareTimeout = *shareTimeout
+		}
+		if set["max-share-size"] {
+			cfg.MaxShareSize = *maxShareSize
+		}
+		if set["proxy"] {
+			cfg.Proxy = *proxy
+		}
+		if set["downloaders"] {
+			cfg.Downloaders = splitList(*downloaders)
+		}
+		if set["link-prefix"] {
+			cfg.LinkPrefix = *linkPrefix
+		}
+		cfg.DryRun = *dryRun
+		cfg.Offline = *offline
+
+		if *failFast {
+			if *keepGoing {
+				return nil, fmt.Errorf("-fail-fast and -keep-going are mutually exclusive")
+			}
+			if set["max-errors"] {
+				return nil, fmt.Errorf("-fail-fast and -max-errors are mutually exclusive")
+			}
+			cfg.MaxErrors = 1
+		}
+		if *keepGoing {
+			if set["max-errors"] {
+				return nil, fmt.Errorf("-keep-going and -max-errors are mutually exclusive")
+			}
+			cfg.MaxErrors = 0
+		}
+
+		err := cfg.validate()
+		if err != nil {
+			return nil, err
+		}
+
+		return cfg, nil
+	}
+}
+
+// parseScrapeArgs defines the scrape command's flags on fs and parses the
+// given command line arguments with it.
+func parseScrapeArgs(fs *flag.FlagSet, args []string) (*Config, error) {
+	buildConfig := bindConfigFlags(fs)
+
+	posArgs, err := parseFlags(fs, args, "source", "dest_dir")
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := buildConfig()
+	if err != nil {
+		return nil, err
+	}
+	cfg.Source = posArgs[0]
+	cfg.DestDir = posArgs[1]
+
+	return cfg, nil
+}
+
+// runConfig implements the config command. Its only subcommand, "dump",
+// prints the effective configuration that the given scrape flags produce.
+func runConfig(cmd *command, args []string) int {
+	flags := cmd.flagSet()
+	buildConfig := bindConfigFlags(flags)
+	showSecrets := flags.Bool("show-secrets", false, "show header values and proxy passwords")
+
+	if len(args) == 0 || args[0] != "dump" {
+		return usageError(flags, fmt.Errorf("missing or unknown subcommand: want dump"))
+	}
+
+	_, err := parseFlags(flags, args[1:])
+	if err != nil {
+		return usageError(flags, err)
+	}
+
+	cfg, err := buildConfig()
+	if err != nil {
+		printFatalError(err)
+		return 1
+	}
+	if !*showSecrets {
+		cfg = cfg.redacted()
+	}
+
+	b, err := yaml.Marshal(cfg)
+	if err != nil {
+		printFatalError(err)
+		return 3
+	}
+	os.Stdout.Write(b)
+
+	return 0
 }
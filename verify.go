@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/ccollins476ad/bdfrscrape/download"
+	"github.com/ccollins476ad/bdfrscrape/fileutil"
+)
+
+// Kinds of problems that verifyArchive reports.
+const (
+	problemUnreadable   = "unreadable"   // A processed post can't be parsed.
+	problemBroken       = "broken"       // A link points to a file that doesn't exist.
+	problemMissing      = "missing"      // The manifest lists a file that doesn't exist.
+	problemTruncated    = "truncated"    // A file is smaller than the manifest says.
+	problemCorrupt      = "corrupt"      // A file is larger than the manifest says, or its hash differs.
+	problemUnreferenced = "unreferenced" // No post links to a media file, directly or through a gallery page.
+)
+
+// VerifyProblem is a problem that verifyArchive found in a destination
+// directory.
+type VerifyProblem struct {
+	Kind   string `json:"kind"`
+	File   string `json:"file"`             // File with the problem, or that holds the broken link; relative to the destination directory.
+	Link   string `json:"link,omitempty"`   // The broken link, as written.
+	Detail string `json:"detail,omitempty"` // Further explanation, if any.
+}
+
+// verifyArchive checks that the processed posts in destDir are intact: that
+// every local link they hold, or that their gallery pages hold, points to an
+// existing file; that each file the manifest lists has its recorded size and,
+// if hash is true, its recorded hash; and that every media file is linked to.
+// The linkPrefix parameter is the prefix of the local links in posts whose
+// prefix the manifest doesn't record.
+func verifyArchive(destDir string, linkPrefix string, hash bool) ([]VerifyProblem, error) {
+	man, err := download.LoadManifest(download.ManifestPath(destDir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load manifest: %w", err)
+	}
+
+	g, err := loadArchiveGraph(destDir, linkPrefix, man)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []VerifyProblem
+
+	for _, filename := range g.Posts {
+		if err := g.Unreadable[filename]; err != nil {
+			problems = append(problems, VerifyProblem{
+				Kind:   problemUnreadable,
+				File:   filename,
+				Detail: err.Error(),
+			})
+		}
+	}
+
+	seen := map[mediaRef]bool{}
+	for _, r := range g.Refs {
+		if seen[r] {
+			continue
+		}
+		seen[r] = true
+
+		if !fileutil.FileExists(filepath.Join(destDir, r.Filename)) {
+			problems = append(problems, VerifyProblem{
+				Kind: problemBroken,
+				File: r.From,
+				Link: r.Link,
+			})
+		}
+	}
+
+	filenames := make([]string, 0, len(man.Files))
+	for filename := range man.Files {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	for _, filename := range filenames {
+		p, err := checkFile(destDir, filename, man.Files[filename], hash)
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			problems = append(problems, *p)
+		}
+	}
+
+	for _, filename := range g.Media {
+		if !g.Referenced[filename] {
+			problems = append(problems, VerifyProblem{
+				Kind: problemUnreferenced,
+				File: filename,
+			})
+		}
+	}
+
+	return problems, nil
+}
+
+// checkFile compares a file against its manifest entry. It returns nil if
+// they match. It only compares hashes if hash is true.
+func checkFile(destDir string, filename string, e *download.ManifestEntry, hash bool) (*VerifyProblem, error) {
+	f, err := os.Open(filepath.Join(destDir, filename))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return &VerifyProblem{
+				Kind: problemMissing,
+				File: filename,
+			}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Size() != e.Size {
+		kind := problemCorrupt
+		if info.Size() < e.Size {
+			kind = problemTruncated
+		}
+		return &VerifyProblem{
+			Kind:   kind,
+			File:   filename,
+			Detail: fmt.Sprintf("size=%d want=%d", info.Size(), e.Size),
+		}, nil
+	}
+
+	if !hash || e.SHA256 == "" {
+		return nil, nil
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash file: filename=%s err=%w", filename, err)
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	if sum != e.SHA256 {
+		return &VerifyProblem{
+			Kind:   problemCorrupt,
+			File:   filename,
+			Detail: fmt.Sprintf("sha256=%s want=%s", sum, e.SHA256),
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// printProblems writes a human-readable list of the given problems to w.
+func printProblems(w io.Writer, problems []VerifyProblem) error {
+	if len(problems) == 0 {
+		fmt.Fprintln(w, "No problems found.")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tFILE\tLINK\tDETAIL")
+	for _, p := range problems {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", p.Kind, p.File, p.Link, p.Detail)
+	}
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\n%d problems found.\n", len(problems))
+	return nil
+}
+
+// runVerify implements the verify command: it checks a destination directory
+// for broken links, damaged files, and unreferenced media.
+func runVerify(cmd *command, args []string) int {
+	flags := cmd.flagSet()
+	buildLinkPrefix := bindLinkPrefixFlags(flags)
+	quick := flags.Bool("quick", false, "check file sizes but not hashes")
+	asJSON := flags.Bool("json", false, "print the problems as json")
+
+	posArgs, err := parseFlags(flags, args, "dest_dir")
+	if err != nil {
+		return usageError(flags, err)
+	}
+	destDir := posArgs[0]
+
+	linkPrefix, err := buildLinkPrefix()
+	if err != nil {
+		printFatalError(err)
+		return 1
+	}
+
+	problems, err := verifyArchive(destDir, linkPrefix, !*quick)
+	if err != nil {
+		printFatalError(err)
+		return 3
+	}
+
+	if *asJSON {
+		if problems == nil {
+			problems = []VerifyProblem{}
+		}
+		b, err := json.MarshalIndent(problems, "", "  ")
+		if err != nil {
+			printFatalError(err)
+			return 3
+		}
+		fmt.Println(string(b))
+	} else {
+		err = printProblems(os.Stdout, problems)
+		if err != nil {
+			printFatalError(err)
+			return 3
+		}
+	}
+
+	if len(problems) > 0 {
+		return 4
+	}
+	return 0
+}
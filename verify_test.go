@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ccollins476ad/bdfrscrape/download"
+	"github.com/ccollins476ad/bdfrscrape/web"
+)
+
+// The files of the archive that newTestArchive builds.
+const (
+	directMedia  = "_bdfrscrape_direct.jpg"   // Linked to by a post.
+	galleryPage  = "_bdfrscrape_album"        // Linked to by a post.
+	galleryMedia = "_bdfrscrape_g1.jpg"       // Only displayed by the gallery page.
+	prefixMedia  = "_bdfrscrape_prefix.jpg"   // Linked to by a post with its own link prefix.
+	orphanMedia  = "_bdfrscrape_orphan.png"   // Linked to by nothing.
+	prefixPost   = "prefix.json"              // The post with its own link prefix.
+	testPrefix   = "media/"                   // Link prefix of the other posts.
+	ownPrefix    = "files/"                   // Link prefix of prefixPost.
+	albumURL     = "https://x.test/album/abc" // Url of the gallery.
+)
+
+// writePost writes a processed post with the given markdown body to destDir.
+func writePost(t *testing.T, destDir string, filename string, selftext string) {
+	t.Helper()
+
+	b, err := json.Marshal(map[string]any{
+		"id":       filename,
+		"selftext": selftext,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(destDir, filename), b, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestArchive builds a destination directory as a scrape would leave it,
+// with one media file that nothing links to (orphanMedia). It returns the
+// directory and its manifest, which it has also saved.
+func newTestArchive(t *testing.T) (string, *download.Manifest) {
+	t.Helper()
+
+	destDir := t.TempDir()
+	man := download.NewManifest()
+	s := download.NewStore(destDir, man, nil)
+
+	save := func(filename string, b []byte) {
+		if err := s.SaveFile(filename, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	save(directMedia, []byte("direct"))
+	err := s.SaveAttribution(directMedia, &download.Attribution{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	save(galleryMedia, []byte("g1"))
+	save(galleryPage, []byte(web.BuildGallery(albumURL, []string{galleryMedia})))
+	save(prefixMedia, []byte("prefix"))
+	save(orphanMedia, []byte("orphan"))
+
+	writePost(t, destDir, "direct.json", "[pic]("+testPrefix+directMedia+")")
+	writePost(t, destDir, "gallery.json", "[album]("+testPrefix+galleryPage+")")
+
+	// Under the default prefix, this post's link would point nowhere.
+	writePost(t, destDir, prefixPost, "[pic]("+ownPrefix+prefixMedia+")")
+	prefix := ownPrefix
+	man.UpdatePost(prefixPost, download.PostEntry{LinkPrefix: &prefix})
+
+	err = man.Save(download.ManifestPath(destDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return destDir, man
+}
+
+func TestVerifyArchive(t *testing.T) {
+	destDir, _ := newTestArchive(t)
+
+	problems, err := verifyArchive(destDir, testPrefix, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []VerifyProblem{{Kind: problemUnreferenced, File: orphanMedia}}
+	if !reflect.DeepEqual(problems, want) {
+		t.Errorf("problems=%+v, want %+v", problems, want)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/ccollins476ad/bdfrscrape/bdfr"
+	"github.com/ccollins476ad/bdfrscrape/markdown"
+	"github.com/ccollins476ad/bdfrscrape/web"
+)
+
+// messageFunc is called for each message in a post. The mdKey and htmlKey
+// parameters name the message's markdown body and its html rendering.
+type messageFunc func(m bdfr.Message, src linkSource, mdKey string, htmlKey string) error
+
+// walkPost calls fn for the given post and then for each of its comments,
+// depth first. The filename parameter is the name of the post's file. It
+// stops at the first error.
+func walkPost(filename string, post bdfr.Message, fn messageFunc) error {
+	src := linkSource{
+		File:      filename,
+		PostID:    post.GetString("id"),
+		Permalink: post.GetString("permalink"),
+	}
+
+	err := fn(post, src, "selftext", "selftext_html")
+	if err != nil {
+		return err
+	}
+
+	comments, err := post.GetSliceOfMessages("comments")
+	if err != nil {
+		return fmt.Errorf("failed to read comments: %w", err)
+	}
+
+	for _, c := range comments {
+		err := walkComment(c, src, fn)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// walkComment calls fn for the given comment and then for each of its
+// replies, depth first.
+func walkComment(c bdfr.Message, post linkSource, fn messageFunc) error {
+	src := post
+	src.CommentID = c.GetString("id")
+	if post.Permalink != "" && src.CommentID != "" {
+		src.Permalink = strings.TrimSuffix(post.Permalink, "/") + "/" + src.CommentID + "/"
+	}
+
+	err := fn(c, src, "body", "body_html")
+	if err != nil {
+		return err
+	}
+
+	replies, err := c.GetSliceOfMessages("replies")
+	if err != nil {
+		return fmt.Errorf("failed to read replies: comment=%s err=%w", src.CommentID, err)
+	}
+
+	for _, r := range replies {
+		err := walkComment(r, post, fn)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// messageLinks returns the distinct links that processMessage would try to
+// save from the given message, in order of first appearance: the links in
+// the markdown body, then the http(s) links in the html rendering.
+func messageLinks(m bdfr.Message, mdKey string, htmlKey string) ([]string, error) {
+	var links []string
+	seen := map[string]bool{}
+
+	add := func(link string) {
+		if !seen[link] {
+			seen[link] = true
+			links = append(links, link)
+		}
+	}
+
+	for _, l := range markdown.Links(m.GetString(mdKey)) {
+		add(l.URL)
+	}
+
+	if body := m.GetString(htmlKey); body != "" {
+		urls, err := web.FragmentURLs(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse html body: %w", err)
+		}
+		for _, u := range urls {
+			pu, err := url.Parse(u)
+			if err == nil && (pu.Scheme == "http" || pu.Scheme == "https") {
+				add(u)
+			}
+		}
+	}
+
+	return links, nil
+}
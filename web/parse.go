@@ -1,7 +1,10 @@
 package web
 
 import (
+	"strings"
+
 	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 )
 
 // extractLinkFromNode returns the href anchor text associated with the given
@@ -86,3 +89,71 @@ func EmbeddedImageURLs(doc *html.Node) []string {
 
 	return urls
 }
+
+// MetaContents returns the "content" attribute of each `meta` element in the
+// given html document whose "property" or "name" attribute is one of the
+// given keys (e.g., "og:image"). The results are ordered by key, then by
+// position in the document.
+func MetaContents(doc *html.Node, keys ...string) []string {
+	byKey := map[string][]string{}
+
+	for _, n := range NodesWithDataVal(doc, "meta") {
+		var key, content string
+		for _, a := range n.Attr {
+			switch a.Key {
+			case "property", "name":
+				key = a.Val
+			case "content":
+				content = a.Val
+			}
+		}
+		if key != "" && content != "" {
+			byKey[key] = append(byKey[key], content)
+		}
+	}
+
+	var contents []string
+	for _, k := range keys {
+		contents = append(contents, byKey[k]...)
+	}
+
+	return contents
+}
+
+// NodeText returns the concatenated text of the given node and its
+// descendants, with runs of whitespace collapsed.
+func NodeText(node *html.Node) string {
+	var sb strings.Builder
+
+	ForEachNode(node, func(n *html.Node) error {
+		if n.Type == html.TextNode {
+			sb.WriteString(n.Data)
+			sb.WriteString(" ")
+		}
+		return nil
+	})
+
+	return strings.Join(strings.Fields(sb.String()), " ")
+}
+
+// PlainText returns the text of the given html fragment with all markup
+// removed.
+func PlainText(fragment string) string {
+	nodes, err := html.ParseFragment(strings.NewReader(fragment), &html.Node{
+		Type:     html.ElementNode,
+		Data:     "body",
+		DataAtom: atom.Body,
+	})
+	if err != nil {
+		return fragment
+	}
+
+	var texts []string
+	for _, n := range nodes {
+		if t := NodeText(n); t != "" {
+			texts = append(texts, t)
+		}
+	}
+
+	return strings.Join(texts, " ")
+}
@@ -0,0 +1,120 @@
+package web
+
+import (
+	"html"
+	"strings"
+
+	nethtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// redditEscaper escapes html the way reddit escapes its *_html fields: only
+// the characters that delimit markup.
+var redditEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// urlAttrs maps element names to the attribute that holds the url of the
+// resource they link to or embed.
+var urlAttrs = map[string]string{
+	"a":      "href",
+	"img":    "src",
+	"video":  "src",
+	"source": "src",
+}
+
+// RewriteURLs replaces the urls in the link and media attributes (a href, img
+// src, etc.) of the given html fragment. For each url, fn returns the
+// replacement and true, or false to leave the url unchanged. If fn also
+// returns a non-empty title, it becomes the element's title attribute unless
+// the element already has one. fn receives urls with html entities already
+// resolved.
+//
+// Reddit's *_html fields hold entity-escaped html (e.g., "&lt;div&gt;"). If
+// the fragment is escaped this way, the result is escaped the same way.
+//
+// The fragment is only re-serialized if some url changes, so unaffected
+// fragments are returned byte-for-byte.
+func RewriteURLs(fragment string, fn func(u string) (string, string, bool)) (string, error) {
+	escaped := strings.HasPrefix(strings.TrimSpace(fragment), "&lt;")
+
+	src := fragment
+	if escaped {
+		src = html.UnescapeString(fragment)
+	}
+
+	nodes, err := nethtml.ParseFragment(strings.NewReader(src), &nethtml.Node{
+		Type:     nethtml.ElementNode,
+		Data:     "body",
+		DataAtom: atom.Body,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	changed := false
+	for _, n := range nodes {
+		ForEachNode(n, func(n *nethtml.Node) error {
+			key, ok := urlAttrs[n.Data]
+			if n.Type != nethtml.ElementNode || !ok {
+				return nil
+			}
+			hasTitle := false
+			for _, a := range n.Attr {
+				if a.Key == "title" {
+					hasTitle = true
+				}
+			}
+
+			for i, a := range n.Attr {
+				if a.Key != key {
+					continue
+				}
+				repl, title, ok := fn(a.Val)
+				if !ok || repl == a.Val {
+					continue
+				}
+				n.Attr[i].Val = repl
+				changed = true
+
+				if title != "" && !hasTitle {
+					n.Attr = append(n.Attr, nethtml.Attribute{Key: "title", Val: title})
+				}
+				break
+			}
+			return nil
+		})
+	}
+
+	if !changed {
+		return fragment, nil
+	}
+
+	var sb strings.Builder
+	for _, n := range nodes {
+		err := nethtml.Render(&sb, n)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	out := sb.String()
+	if escaped {
+		out = redditEscaper.Replace(out)
+	}
+
+	return out, nil
+}
+
+// FragmentURLs returns the urls in the link and media attributes of the given
+// html fragment, in document order, with html entities resolved. Like
+// RewriteURLs, it accepts reddit's entity-escaped *_html fields.
+func FragmentURLs(fragment string) ([]string, error) {
+	var urls []string
+	_, err := RewriteURLs(fragment, func(u string) (string, string, bool) {
+		urls = append(urls, u)
+		return "", "", false
+	})
+	if err != nil {
+		return nil, err
+	}
+	return urls, nil
+}
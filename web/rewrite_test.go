@@ -0,0 +1,111 @@
+package web
+
+import (
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// redditFragment is a selftext_html field as reddit escapes it: the html is
+// entity-escaped once more, so the "&" in a url's query is "&amp;amp;",
+// attribute quotes are "&quot;" and a quote inside an attribute is
+// "&amp;quot;".
+const redditFragment = `&lt;!-- SC_OFF --&gt;&lt;div class=&quot;md&quot;&gt;&lt;p&gt;` +
+	`&lt;a href=&quot;https://i.example.com/a.jpg?w=1&amp;amp;h=2&quot;&gt;pic&lt;/a&gt; ` +
+	`&lt;img src=&quot;https://i.example.com/b.png&quot; title=&quot;say &amp;quot;hi&amp;quot;&quot;/&gt; ` +
+	`&lt;a href=&quot;https://example.com/page&quot;&gt;page &amp;amp; more&lt;/a&gt;` +
+	`&lt;/p&gt;&lt;/div&gt;&lt;!-- SC_ON --&gt;`
+
+// rewriteMedia stands in for the scraper: it rewrites links to .jpg and .png
+// files to "media/<base>" with the original url as the title, and leaves
+// other links alone. It records the urls it sees.
+func rewriteMedia(seen *[]string) func(u string) (string, string, bool) {
+	return func(u string) (string, string, bool) {
+		*seen = append(*seen, u)
+		base, _, _ := strings.Cut(path.Base(u), "?")
+		if ext := path.Ext(base); ext != ".jpg" && ext != ".png" {
+			return "", "", false
+		}
+		return "media/" + base, u, true
+	}
+}
+
+func TestRewriteURLsEscaped(t *testing.T) {
+	var seen []string
+	got, err := RewriteURLs(redditFragment, rewriteMedia(&seen))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantSeen := []string{
+		"https://i.example.com/a.jpg?w=1&h=2",
+		"https://i.example.com/b.png",
+		"https://example.com/page",
+	}
+	if !reflect.DeepEqual(seen, wantSeen) {
+		t.Errorf("fn saw %q, want %q", seen, wantSeen)
+	}
+
+	// The renderer quotes attributes with a bare '"', which the reddit
+	// escaping leaves alone, and writes a quote inside a value as "&#34;",
+	// which it turns into "&amp;#34;". Both decode to the same html as the
+	// "&quot;" and "&amp;quot;" reddit sent. An element with a title keeps it.
+	want := `&lt;!-- SC_OFF --&gt;&lt;div class="md"&gt;&lt;p&gt;` +
+		`&lt;a href="media/a.jpg" title="https://i.example.com/a.jpg?w=1&amp;amp;h=2"&gt;pic&lt;/a&gt; ` +
+		`&lt;img src="media/b.png" title="say &amp;#34;hi&amp;#34;"/&gt; ` +
+		`&lt;a href="https://example.com/page"&gt;page &amp;amp; more&lt;/a&gt;` +
+		`&lt;/p&gt;&lt;/div&gt;&lt;!-- SC_ON --&gt;`
+	if got != want {
+		t.Errorf("rewrite mismatch\n got: %s\nwant: %s", got, want)
+	}
+}
+
+func TestRewriteURLsPlain(t *testing.T) {
+	fragment := `<p><a href="https://i.example.com/a.jpg?w=1&amp;h=2">pic</a> <a href="https://example.com/page">page</a></p>`
+
+	var seen []string
+	got, err := RewriteURLs(fragment, rewriteMedia(&seen))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `<p><a href="media/a.jpg" title="https://i.example.com/a.jpg?w=1&amp;h=2">pic</a> <a href="https://example.com/page">page</a></p>`
+	if got != want {
+		t.Errorf("rewrite mismatch\n got: %s\nwant: %s", got, want)
+	}
+}
+
+func TestRewriteURLsUnchanged(t *testing.T) {
+	// Only non-media links: the fragment comes back byte-for-byte, not
+	// re-serialized.
+	fragment := `&lt;div class=&quot;md&quot;&gt;&lt;p&gt;&lt;a href=&quot;https://example.com/page?a=1&amp;amp;b=2&quot;&gt;page&lt;/a&gt;&lt;/p&gt;&lt;/div&gt;`
+
+	var seen []string
+	got, err := RewriteURLs(fragment, rewriteMedia(&seen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != fragment {
+		t.Errorf("unchanged fragment was altered\n got: %s\nwant: %s", got, fragment)
+	}
+	if want := []string{"https://example.com/page?a=1&b=2"}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("fn saw %q, want %q", seen, want)
+	}
+}
+
+func TestFragmentURLs(t *testing.T) {
+	urls, err := FragmentURLs(redditFragment)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"https://i.example.com/a.jpg?w=1&h=2",
+		"https://i.example.com/b.png",
+		"https://example.com/page",
+	}
+	if !reflect.DeepEqual(urls, want) {
+		t.Errorf("FragmentURLs=%q, want %q", urls, want)
+	}
+}
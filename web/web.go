@@ -2,21 +2,46 @@ package web
 
 import (
 	"fmt"
+	"html"
+	"path"
 	"strings"
+
+	nethtml "golang.org/x/net/html"
 )
 
-// BuildGallery constructs an html web page displaying images with the given
-// filenames.
-func BuildGallery(filenames []string) string {
-	sb := strings.Builder{}
+// videoExts is the set of filename extensions that BuildGallery displays with
+// a video element rather than an image element.
+var videoExts = map[string]struct{}{
+	".mp4":  {},
+	".webm": {},
+}
 
-	sb.WriteString(`<!DOCTYPE html>
+// galleryHeader begins every page that BuildGallery constructs.
+const galleryHeader = `<!DOCTYPE html>
 <html>
 <body>
-`)
+`
+
+// BuildGallery constructs an html web page displaying images with the given
+// filenames. If source is not empty, the page credits it as the original
+// location of the media.
+func BuildGallery(source string, filenames []string) string {
+	sb := strings.Builder{}
+
+	sb.WriteString(galleryHeader)
+
+	if source != "" {
+		esc := html.EscapeString(source)
+		sb.WriteString(fmt.Sprintf("<p>Source: <a href=\"%s\">%s</a></p>\n", esc, esc))
+	}
 
 	for _, f := range filenames {
-		sb.WriteString(fmt.Sprintf("<img src=\"%s\" alt=\"%s\" style=\"background-size:100% 100%\">\n", f, f))
+		esc := html.EscapeString(f)
+		if _, ok := videoExts[strings.ToLower(path.Ext(f))]; ok {
+			sb.WriteString(fmt.Sprintf("<video src=\"%s\" controls></video>\n", esc))
+		} else {
+			sb.WriteString(fmt.Sprintf("<img src=\"%s\" alt=\"%s\" style=\"background-size:100%% 100%%\">\n", esc, esc))
+		}
 	}
 
 	sb.WriteString(`</body>
@@ -25,3 +50,33 @@ func BuildGallery(filenames []string) string {
 
 	return sb.String()
 }
+
+// IsGallery returns true if the given page, or its beginning, looks like one
+// that BuildGallery constructed.
+func IsGallery(page []byte) bool {
+	return strings.HasPrefix(string(page), galleryHeader)
+}
+
+// GalleryFilenames returns the filenames of the media that the given page,
+// constructed by BuildGallery, displays.
+func GalleryFilenames(page string) ([]string, error) {
+	doc, err := nethtml.Parse(strings.NewReader(page))
+	if err != nil {
+		return nil, err
+	}
+
+	var filenames []string
+	ForEachNode(doc, func(n *nethtml.Node) error {
+		if n.Type != nethtml.ElementNode || (n.Data != "img" && n.Data != "video") {
+			return nil
+		}
+		for _, a := range n.Attr {
+			if a.Key == "src" {
+				filenames = append(filenames, a.Val)
+			}
+		}
+		return nil
+	})
+
+	return filenames, nil
+}